@@ -0,0 +1,92 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// The address index has an empty entry for every unspent output, keyed by
+// the 20 byte hash of the address the output pays followed by its outpoint
+// key, so the coins of one address can be found with a prefix scan. It is
+// written alongside the UTXO bucket by updateUTXO, disconnectUTXO and
+// reindexUTXO.
+const addrIndexBucket = "addrindex"
+
+// addressHash returns the hash an output is indexed under: the pubkey hash
+// of a P2PKH script, the script hash of a P2SH script, and the hash160 of
+// the script itself for any other kind
+func addressHash(lockScript []byte) []byte{
+	if pubkeyhash := extractPubKeyHash(lockScript); pubkeyhash != nil{
+		return pubkeyhash
+	}
+	if isP2SH(lockScript){
+		return lockScript[2:22]
+	}
+	return HashPubKey(lockScript)
+}
+
+func addrIndexKey(lockScript, txid []byte, index int) []byte{
+	return append(append([]byte{}, addressHash(lockScript)...), outpointKey(txid, index)...)
+}
+
+func indexOutput(b *bolt.Bucket, lockScript, txid []byte, index int) error{
+	return b.Put(addrIndexKey(lockScript, txid, index), []byte{})
+}
+
+func unindexOutput(b *bolt.Bucket, lockScript, txid []byte, index int) error{
+	return b.Delete(addrIndexKey(lockScript, txid, index))
+}
+
+// buildAddrIndex indexes every output in the UTXO bucket, for databases
+// written before the index existed
+func buildAddrIndex(tx *bolt.Tx) error{
+	if tx.Bucket([]byte(addrIndexBucket)) != nil{
+		return nil
+	}
+	ub := tx.Bucket([]byte(utxoBucket))
+	if ub == nil{
+		return nil
+	}
+	fmt.Println("building the address index")
+	b, err := tx.CreateBucket([]byte(addrIndexBucket))
+	if err != nil{
+		return err
+	}
+	c := ub.Cursor()
+	for k,v:=c.First();k!=nil;k,v=c.Next(){
+		entry, err := DeserializeUTXOEntry(v)
+		if err != nil{
+			return err
+		}
+		txid, index := splitOutpointKey(k)
+		err = indexOutput(b, entry.Output.LockScript, txid, index)
+		if err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachLockedBy calls fn for the unspent outputs locked by lockScript in
+// outpoint order, stopping early when fn returns false
+func forEachLockedBy(tx *bolt.Tx, lockScript []byte, fn func(txid []byte, index int, entry UTXOEntry) bool) error{
+	ub := tx.Bucket([]byte(utxoBucket))
+	prefix := addressHash(lockScript)
+	c := tx.Bucket([]byte(addrIndexBucket)).Cursor()
+	for k,_:=c.Seek(prefix);k!=nil && bytes.HasPrefix(k, prefix);k,_=c.Next(){
+		txid, index := splitOutpointKey(k[len(prefix):])
+		entry, ok := findUnspentOutput(ub, txid, index)
+		if !ok{
+			return fmt.Errorf("address index entry %x has no unspent output", k)
+		}
+		// another kind of script can pay the same hash
+		if !bytes.Equal(entry.Output.LockScript, lockScript){
+			continue
+		}
+		if !fn(txid, index, entry){
+			break
+		}
+	}
+	return nil
+}
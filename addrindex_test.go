@@ -0,0 +1,72 @@
+package blockchain_practice
+
+import (
+	"reflect"
+	"testing"
+	"github.com/boltdb/bolt"
+)
+
+// bucketContents returns what the named bucket holds
+func bucketContents(t *testing.T, bc *Blockchain, name string) map[string]string{
+	contents := make(map[string]string)
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		return tx.Bucket([]byte(name)).ForEach(func(k, v []byte)error{
+			contents[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	return contents
+}
+
+// lockedBy returns the total value of the outputs FindUTXO gives for lock
+// and of those a scan of the whole UTXO set finds
+func lockedBy(bc *Blockchain, lock []byte) (int, int){
+	indexed, scanned := 0, 0
+	for _,out := range (UTXOSet{bc}).FindUTXO(lock){
+		indexed += out.Value
+	}
+	UTXOSet{bc}.forEach(func(txid []byte, index int, entry UTXOEntry){
+		if string(entry.Output.LockScript) == string(lock){
+			scanned += entry.Output.Value
+		}
+	})
+	return indexed, scanned
+}
+
+func TestAddressIndex(t *testing.T){
+	bc, wallet, spend := spendingChain(t)
+	recipient := spend.Vout[0].LockScript
+	own := NewP2PKHScript(HashPubKey(wallet.PublicKey))
+	for _,lock := range [][]byte{recipient, own}{
+		if indexed, scanned := lockedBy(bc, lock); indexed != scanned || indexed == 0{
+			t.Fatalf("%x: index finds %d, the UTXO set holds %d", lock, indexed, scanned)
+		}
+	}
+	if len(bucketContents(t, bc, addrIndexBucket)) != len(bucketContents(t, bc, utxoBucket)){
+		t.Fatal("index and UTXO set sizes differ")
+	}
+	// disconnecting the spend takes the recipient's coins out of the index
+	if _, err := bc.Rollback(1); err != nil{
+		t.Fatal(err)
+	}
+	if indexed, _ := lockedBy(bc, recipient); indexed != 0{
+		t.Fatal("disconnected output still indexed", indexed)
+	}
+	maintained := bucketContents(t, bc, addrIndexBucket)
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		err := tx.DeleteBucket([]byte(addrIndexBucket))
+		if err != nil{
+			return err
+		}
+		return buildAddrIndex(tx)
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(maintained, bucketContents(t, bc, addrIndexBucket)){
+		t.Fatal("maintained index differs from a rebuilt one")
+	}
+}
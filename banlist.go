@@ -0,0 +1,190 @@
+package blockchain_practice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+// Each peer carries a ban score that grows with every invalid message,
+// block or transaction it sends. Once it reaches banThreshold the peer is
+// dropped and its address banned for banDuration. Bans are kept in the
+// chain database under the address, or only the host to ban every port,
+// so they survive restarts.
+const (
+	banBucket = "banned"
+	banThreshold = 100
+	banDuration = 24 * time.Hour
+)
+
+var (
+	ErrMalformedMessage = errors.New("malformed message")
+	ErrBanned = errors.New("address is banned")
+)
+
+type Ban struct{
+	Addr 		string
+	Until 		time.Time
+	Reason 	string
+}
+
+func (b Ban) Serialize() []byte{
+	e := &encoder{}
+	e.writeUint64(uint64(b.Until.Unix()))
+	e.writeVarBytes([]byte(b.Reason))
+	return e.Bytes()
+}
+
+func DeserializeBan(addr string, data []byte) (Ban, error){
+	d := &decoder{data: data}
+	until := d.readUint64()
+	reason := d.readVarBytes()
+	err := d.finish()
+	if err != nil{
+		return Ban{}, err
+	}
+	return Ban{addr, time.Unix(int64(until), 0), string(reason)}, nil
+}
+
+// banScore is how much a peer is penalised for sending what failed with
+// err. Blocks we cannot place yet, that were invalidated here or that are
+// ahead of our clock are not the sender's fault.
+func banScore(err error) int{
+	var blockErr *BlockError
+	switch {
+	case errors.Is(err, ErrMalformedMessage):
+		return banThreshold
+	case errors.Is(err, ErrUnconnectingHeaders):
+		return 20
+	case errors.Is(err, ErrTooManySideHeaders):
+		return banThreshold
+	case errors.Is(err, ErrUnknownParent), errors.Is(err, ErrInvalidated), errors.Is(err, ErrFutureBlock):
+		return 0
+	case errors.As(err, &blockErr):
+		return banThreshold
+	case errors.Is(err, ErrInvalidTx):
+		return 10
+	}
+	return 0
+}
+
+// malformed wraps an error decoding a payload
+func malformed(command string, err error) error{
+	return fmt.Errorf("%w: %s: %s", ErrMalformedMessage, command, err)
+}
+
+// Ban bans addr until the given time, dropping bans that have expired
+func (bc *Blockchain) Ban(addr string, until time.Time, reason string) error{
+	return bc.db.Update(func(tx *bolt.Tx)error{
+		b, err := tx.CreateBucketIfNotExists([]byte(banBucket))
+		if err != nil{
+			return err
+		}
+		var expired [][]byte
+		now := time.Now()
+		err = b.ForEach(func(k, v []byte)error{
+			ban, err := DeserializeBan(string(k), v)
+			if err != nil || !ban.Until.After(now){
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil{
+			return err
+		}
+		for _,k := range expired{
+			err = b.Delete(k)
+			if err != nil{
+				return err
+			}
+		}
+		return b.Put([]byte(addr), Ban{addr, until, reason}.Serialize())
+	})
+}
+
+// Unban lifts the ban on addr. It reports whether there was one.
+func (bc *Blockchain) Unban(addr string) (bool, error){
+	found := false
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(banBucket))
+		if b == nil || b.Get([]byte(addr)) == nil{
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(addr))
+	})
+	return found, err
+}
+
+func (bc *Blockchain) ClearBans() error{
+	return bc.db.Update(func(tx *bolt.Tx)error{
+		err := tx.DeleteBucket([]byte(banBucket))
+		if err == bolt.ErrBucketNotFound{
+			return nil
+		}
+		return err
+	})
+}
+
+// Bans returns the bans in force, soonest to expire first
+func (bc *Blockchain) Bans() []Ban{
+	var bans []Ban
+	now := time.Now()
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(banBucket))
+		if b == nil{
+			return nil
+		}
+		return b.ForEach(func(k, v []byte)error{
+			ban, err := DeserializeBan(string(k), v)
+			if err != nil{
+				return err
+			}
+			if ban.Until.After(now){
+				bans = append(bans, ban)
+			}
+			return nil
+		})
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	sort.Slice(bans, func(i, j int) bool{
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// IsBanned reports whether addr, or the host part of it, is banned
+func (bc *Blockchain) IsBanned(addr string) bool{
+	keys := []string{addr}
+	if host, _, err := net.SplitHostPort(addr); err == nil{
+		keys = append(keys, host)
+	}
+	banned := false
+	now := time.Now()
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(banBucket))
+		if b == nil{
+			return nil
+		}
+		for _,key := range keys{
+			if v := b.Get([]byte(key)); v != nil{
+				ban, err := DeserializeBan(key, v)
+				if err != nil{
+					return err
+				}
+				banned = banned || ban.Until.After(now)
+			}
+		}
+		return nil
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return banned
+}
@@ -17,7 +17,8 @@ func Base58Encode(input []byte) []byte{
 		x.DivMod(x, base, mod)
 		result = append(result, b58Alphabet[mod.Int64()])
 	}
-	if input[0] == 0x00{
+	// every leading zero byte is one leading '1'
+	for i := 0; i < len(input) && input[i] == 0x00; i++{
 		result = append(result, b58Alphabet[0])
 	}
 	ReverseBytes(result)
@@ -31,9 +32,9 @@ func Base58Decode(input []byte) []byte{
 		result.Mul(result, big.NewInt(58))
 		result.Add(result, big.NewInt(int64(charIndex)))
 	}
-	decoded := result.Bytes()
-	if input[0] == b58Alphabet[0]{
-		decoded = append([]byte{0x00}, decoded...)
+	zeros := 0
+	for zeros < len(input) && input[zeros] == b58Alphabet[0]{
+		zeros++
 	}
-	return decoded
+	return append(make([]byte, zeros), result.Bytes()...)
 }
\ No newline at end of file
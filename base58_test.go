@@ -0,0 +1,20 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBase58LeadingZeros(t *testing.T){
+	for _,input := range [][]byte{{0}, {0, 0, 1}, {0, 0, 0, 0xff, 0}, {1, 0}}{
+		encoded := Base58Encode(input)
+		if got := Base58Decode(encoded); !bytes.Equal(got, input){
+			t.Errorf("%x: encoded as %s, decoded to %x", input, encoded, got)
+		}
+	}
+	// a hash with a leading zero byte follows the zero version byte
+	address := encodeAddress(version, append([]byte{0}, bytes.Repeat([]byte{7}, 19)...))
+	if !ValidateAddress(string(address)){
+		t.Errorf("%s is not valid", address)
+	}
+}
@@ -3,21 +3,39 @@ package blockchain_practice
 import (
 	"time"
 	"bytes"
-	"encoding/gob"
-	"log"
+	"encoding/binary"
+	"crypto/sha256"
+	"fmt"
 )
 
-type Block struct{
+const headersBucket = "headers"
+const headerLen = 32 + 32 + 8 + 8 + 4 + 8
+
+// BlockHeader is the part of a block that is hashed and mined. It commits
+// to the transactions through MerkleRoot.
+type BlockHeader struct{
 	Timestamp 		int64
-	Transactions 	[]*Transaction
 	PreBlockHash 	[]byte
-	Hash 				[]byte
+	MerkleRoot 	[]byte
 	Height				int
+	Bits 				uint32
 	Nonce 				int
 }
 
-func NewBlock(txs []*Transaction, preblockHash []byte, height int) *Block{
-	block := &Block{time.Now().Unix(), txs, preblockHash, []byte{}, height, 0}
+type Block struct{
+	BlockHeader
+	Transactions 	[]*Transaction
+	Hash 				[]byte
+}
+
+func NewBlock(txs []*Transaction, preblockHash []byte, height int, bits uint32) *Block{
+	return NewBlockAt(txs, preblockHash, height, bits, time.Now().Unix())
+}
+
+// NewBlockAt mines a block with the given timestamp
+func NewBlockAt(txs []*Transaction, preblockHash []byte, height int, bits uint32, timestamp int64) *Block{
+	block := &Block{BlockHeader{timestamp, preblockHash, nil, height, bits, 0}, txs, []byte{}}
+	block.MerkleRoot = block.HashTransactions()
 	pow := NewProofOfWork(block)
 	nonce, hash := pow.Run()
 	block.Nonce = nonce
@@ -26,7 +44,7 @@ func NewBlock(txs []*Transaction, preblockHash []byte, height int) *Block{
 }
 
 func NewOrgBlock(coinbase *Transaction) *Block{
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, BigToCompact(powLimit))
 }
 
 func (b *Block) HashTransactions() []byte{
@@ -38,22 +56,77 @@ func (b *Block) HashTransactions() []byte{
 	return mTree.RootNode.Data
 }
 
+// Serialize writes the format version, the header and then the
+// transactions. The block hash is not written, it is the header's hash.
 func (b *Block) Serialize() []byte{
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(b)
-	if err != nil{
-		log.Panic(err)
+	e := &encoder{}
+	e.writeUint32(blockFormatVersion)
+	e.buf.Write(b.BlockHeader.Serialize())
+	e.writeVarInt(uint64(len(b.Transactions)))
+	for _,tx := range b.Transactions{
+		tx.encode(e)
 	}
-	return buf.Bytes()
+	return e.Bytes()
 }
 
-func DeserializeBlock(buf []byte) *Block{
-	var block *Block
-	dec := gob.NewDecoder(bytes.NewReader(buf))
-	err := dec.Decode(block)
+func DeserializeBlock(data []byte) (*Block, error){
+	d := &decoder{data: data}
+	if version := d.readUint32(); version != blockFormatVersion{
+		d.fail("unknown block version %d", version)
+	}
+	headerdata := d.next(headerLen)
+	if d.err != nil{
+		return nil, d.err
+	}
+	header, err := DeserializeHeader(headerdata)
 	if err != nil{
-		log.Panic(err)
+		return nil, err
 	}
-	return block
-}
\ No newline at end of file
+	block := &Block{*header, nil, header.Hash()}
+	for i, n := 0, d.readCount(6); i < n; i++{
+		tx := decodeTransaction(d)
+		block.Transactions = append(block.Transactions, &tx)
+	}
+	err = d.finish()
+	if err != nil{
+		return nil, err
+	}
+	return block, nil
+}
+
+// Serialize writes the header in its fixed-size canonical form: the two
+// hashes padded to 32 bytes followed by little-endian integers. The genesis
+// block's empty PreBlockHash is written as zeros.
+func (h *BlockHeader) Serialize() []byte{
+	data := make([]byte, headerLen)
+	copy(data[0:32], h.PreBlockHash)
+	copy(data[32:64], h.MerkleRoot)
+	binary.LittleEndian.PutUint64(data[64:72], uint64(h.Timestamp))
+	binary.LittleEndian.PutUint64(data[72:80], uint64(h.Height))
+	binary.LittleEndian.PutUint32(data[80:84], h.Bits)
+	binary.LittleEndian.PutUint64(data[84:92], uint64(h.Nonce))
+	return data
+}
+
+func (h *BlockHeader) Hash() []byte{
+	hash := sha256.Sum256(h.Serialize())
+	return hash[:]
+}
+
+func DeserializeHeader(data []byte) (*BlockHeader, error){
+	if len(data) != headerLen{
+		return nil, fmt.Errorf("%w: header is %d bytes", ErrMalformed, len(data))
+	}
+	h := &BlockHeader{}
+	if !bytes.Equal(data[0:32], make([]byte, 32)){
+		h.PreBlockHash = append([]byte{}, data[0:32]...)
+	}else{
+		h.PreBlockHash = []byte{}
+	}
+	h.MerkleRoot = append([]byte{}, data[32:64]...)
+	h.Timestamp = int64(binary.LittleEndian.Uint64(data[64:72]))
+	h.Height = int(binary.LittleEndian.Uint64(data[72:80]))
+	h.Bits = binary.LittleEndian.Uint32(data[80:84])
+	h.Nonce = int(binary.LittleEndian.Uint64(data[84:92]))
+	return h, nil
+}
@@ -4,22 +4,24 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"bytes"
-	"encoding/gob"
-	"crypto/cipher"
-	"net/mail"
 	"os"
 	"log"
 	"errors"
-	"encoding/hex"
 	"crypto/ecdsa"
+	"math/big"
+	"time"
 )
 
 const(
 	dbFile = "blockchain_%s.db"
 	blocksBucket = "blocks"
+	chainworkBucket = "chainwork"
 	genesisCoinbaseData = "The Genesis Block"
 )
 
+// ErrStaleTip is returned by MineBlock when the chain moved on while mining
+var ErrStaleTip = errors.New("tip changed while mining")
+
 type Blockchain struct{
 	tail 	[]byte
 	db 	*bolt.DB
@@ -32,27 +34,15 @@ func CreateBlockchainDB(addr, nodeID string) *Blockchain{
 		os.Exit(1)
 	}
 	var tail []byte
-	cbtx := NewCoinbaseTX(addr, genesisCoinbaseData)
+	cbtx := NewCoinbaseTX(addr, genesisCoinbaseData, 0, 0)
 	orgBlock := NewOrgBlock(cbtx)
 	db,err := bolt.Open(dbFile, 0600, nil)
 	if err != nil{
 		log.Panic(err)
 	}
 	err = db.Update(func(tx *bolt.Tx)error{
-		b, err := tx.CreateBucket([]byte(blocksBucket))
-		if err != nil{
-			log.Panic(err)
-		}
-		err = b.Put(orgBlock.Hash, orgBlock.Serialize())
-		if err != nil{
-			log.Panic(err)
-		}
-		err = b.Put([]byte("l"), orgBlock.Hash)
-		if err != nil{
-			log.Panic(err)
-		}
 		tail = orgBlock.Hash
-		return nil
+		return storeGenesis(tx, orgBlock)
 	})
 	if err != nil{
 		log.Panic(err)
@@ -61,6 +51,31 @@ func CreateBlockchainDB(addr, nodeID string) *Blockchain{
 	return bc
 }
 
+// storeGenesis starts an empty database with the genesis block as its tip
+func storeGenesis(tx *bolt.Tx, genesis *Block) error{
+	b, err := tx.CreateBucket([]byte(blocksBucket))
+	if err != nil{
+		return err
+	}
+	err = b.Put(genesis.Hash, genesis.Serialize())
+	if err != nil{
+		return err
+	}
+	err = b.Put([]byte("l"), genesis.Hash)
+	if err != nil{
+		return err
+	}
+	err = putHeader(tx, genesis)
+	if err != nil{
+		return err
+	}
+	_, err = putChainWork(tx, genesis)
+	if err != nil{
+		return err
+	}
+	return indexMainChain(tx)
+}
+
 func NewBlockChain(nodeID string) *Blockchain{
 	dbfile := fmt.Sprintf(dbFile, nodeID)
 	if dbExist(dbfile) == false{
@@ -72,96 +87,271 @@ func NewBlockChain(nodeID string) *Blockchain{
 	if err != nil{
 		log.Panic(err)
 	}
-	err = db.View(func(tx *bolt.Tx)error{
+	if oldTxFormat(db){
+		fmt.Println("the database was written before transaction lock times and cannot be read, delete it and create the chain again")
+		os.Exit(1)
+	}
+	err = db.Update(func(tx *bolt.Tx)error{
 		b := tx.Bucket([]byte(blocksBucket))
-		tail = b.Get([]byte("l"))
-		return nil
+		tail = append([]byte{}, b.Get([]byte("l"))...)
+		err := indexHeaders(tx)
+		if err != nil{
+			return err
+		}
+		err = indexChainWork(tx)
+		if err != nil{
+			return err
+		}
+		err = indexMainChain(tx)
+		if err != nil{
+			return err
+		}
+		err = migrateUndo(tx)
+		if err != nil{
+			return err
+		}
+		return migrateUTXO(tx)
 	})
 	if err != nil{
 		log.Panic(err)
 	}
 	bc := &Blockchain{tail, db}
+	if reason, invalid := bc.SnapshotInvalid(); invalid{
+		fmt.Printf("the UTXO snapshot this chain started from failed validation: %s\n", reason)
+		fmt.Println("delete the database and create or load the chain again")
+		os.Exit(1)
+	}
 	return bc
 }
 
-func (bc *Blockchain) AddBlock(block *Block){
+// AddBlock validates a block received from a peer and stores it. If the
+// block's chain has more work than the current one it is connected to the
+// UTXO set, reorganizing away from the old tip when needed, all in one bolt
+// transaction. On equal work the chain seen first is kept. The non-coinbase
+// transactions of disconnected blocks that did not make it into the new
+// chain are returned so they can go back to the mempool.
+func (bc *Blockchain) AddBlock(block *Block) ([]*Transaction, error){
+	var orphaned []*Transaction
 	err := bc.db.Update(func(tx *bolt.Tx)error{
-		b := tx.Bucket([]byte(blocksBucket))
-		if b.Get(block.Hash) != nil{
-			//fmt.Printf("%x exists\n", block.Hash)
-			return nil
+		var err error
+		orphaned, err = bc.storeBlock(tx, block)
+		return err
+	})
+	if err != nil{
+		return nil, err
+	}
+	return orphaned, nil
+}
+
+// storeBlock is AddBlock inside the caller's bolt transaction
+func (bc *Blockchain) storeBlock(tx *bolt.Tx, block *Block) ([]*Transaction, error){
+	var orphaned []*Transaction
+	b := tx.Bucket([]byte(blocksBucket))
+	if b.Get(block.Hash) != nil{
+		//fmt.Printf("%x exists\n", block.Hash)
+		return nil, nil
+	}
+	err := checkBlock(tx, block)
+	if err != nil{
+		return nil, err
+	}
+	err = b.Put(block.Hash, block.Serialize())
+	if err != nil{
+		log.Panic(err)
+	}
+	err = putHeader(tx, block)
+	if err != nil{
+		return nil, err
+	}
+	work, err := putChainWork(tx, block)
+	if err != nil{
+		return nil, err
+	}
+	lasthash := b.Get([]byte("l"))
+	if work.Cmp(chainWork(tx, lasthash)) > 0{
+		if bytes.Equal(lasthash, block.PreBlockHash){
+			err = connectBlock(tx, block)
+		}else{
+			orphaned, err = reorganize(tx, lasthash, block)
+		}
+		if err != nil{
+			return nil, err
 		}
-		err := b.Put(block.Hash, block.Serialize())
+		err := b.Put([]byte("l"), block.Hash)
 		if err != nil{
 			log.Panic(err)
 		}
-		lasthash := b.Get([]byte("l"))
-		lastblockdata := b.Get(lasthash)
-		lastblock := DeserializeBlock(lastblockdata)
-		if lastblock.Height < block.Height{
-			err := b.Put([]byte("l"), block.Hash)
-			if err != nil{
-				log.Panic(err)
-			}
-			bc.tail = block.Hash
+		bc.tail = block.Hash
+	}
+	return orphaned, nil
+}
+
+// getHeader returns the stored header of hash, or nil if it is unknown
+func getHeader(tx *bolt.Tx, hash []byte) *BlockHeader{
+	data := tx.Bucket([]byte(headersBucket)).Get(hash)
+	if data == nil{
+		return nil
+	}
+	header, err := DeserializeHeader(data)
+	if err != nil{
+		log.Panic(err)
+	}
+	return header
+}
+
+func putHeader(tx *bolt.Tx, block *Block) error{
+	b, err := tx.CreateBucketIfNotExists([]byte(headersBucket))
+	if err != nil{
+		return err
+	}
+	return b.Put(block.Hash, block.BlockHeader.Serialize())
+}
+
+// chainWork returns the cumulative work of the chain ending at hash
+func chainWork(tx *bolt.Tx, hash []byte) *big.Int{
+	data := tx.Bucket([]byte(chainworkBucket)).Get(hash)
+	return new(big.Int).SetBytes(data)
+}
+
+// putChainWork records block's cumulative work, its parent's plus its own
+func putChainWork(tx *bolt.Tx, block *Block) (*big.Int, error){
+	b, err := tx.CreateBucketIfNotExists([]byte(chainworkBucket))
+	if err != nil{
+		return nil, err
+	}
+	work := CalcWork(block.Bits)
+	if len(block.PreBlockHash) > 0{
+		work.Add(work, chainWork(tx, block.PreBlockHash))
+	}
+	return work, b.Put(block.Hash, work.Bytes())
+}
+
+// oldTxFormat reports whether the stored blocks hold transactions in the
+// format used before lock times
+func oldTxFormat(db *bolt.DB) bool{
+	old := false
+	err := db.View(func(tx *bolt.Tx)error{
+		c := tx.Bucket([]byte(blocksBucket)).Cursor()
+		k, v := c.First()
+		if string(k) == "l"{
+			k, v = c.Next()
+		}
+		if k != nil{
+			_, err := DeserializeBlock(v)
+			old = errors.Is(err, ErrOldTxFormat)
 		}
 		return nil
 	})
 	if err != nil{
 		log.Panic(err)
 	}
+	return old
 }
 
-func (bc *Blockchain) FindTransaction(id []byte) (Transaction, error){
-	bci := bc.Iterator()
-	for {
-		block := bci.Next()
-		for _,tx := range block.Transactions{
-			if bytes.Compare(tx.HashID, id) == 0{
-				return *tx, nil
+// indexHeaders stores the headers of blocks saved before headers were kept
+// on their own
+func indexHeaders(tx *bolt.Tx) error{
+	if tx.Bucket([]byte(headersBucket)) != nil{
+		return nil
+	}
+	_, err := tx.CreateBucket([]byte(headersBucket))
+	if err != nil{
+		return err
+	}
+	c := tx.Bucket([]byte(blocksBucket)).Cursor()
+	for k,v:=c.First();k!=nil;k,v=c.Next(){
+		if string(k) == "l"{
+			continue
+		}
+		block, err := DeserializeBlock(v)
+		if err != nil{
+			return err
+		}
+		err = putHeader(tx, block)
+		if err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// indexChainWork fills in the chain work of blocks stored before it was
+// tracked
+func indexChainWork(tx *bolt.Tx) error{
+	if tx.Bucket([]byte(chainworkBucket)) != nil{
+		return nil
+	}
+	_, err := tx.CreateBucket([]byte(chainworkBucket))
+	if err != nil{
+		return err
+	}
+	b := tx.Bucket([]byte(blocksBucket))
+	var index func(hash []byte) error
+	index = func(hash []byte) error{
+		if tx.Bucket([]byte(chainworkBucket)).Get(hash) != nil{
+			return nil
+		}
+		block, err := DeserializeBlock(b.Get(hash))
+		if err != nil{
+			return err
+		}
+		if len(block.PreBlockHash) > 0{
+			if err := index(block.PreBlockHash); err != nil{
+				return err
 			}
 		}
-		if len(block.PreBlockHash) == 0{
-			break
+		_, err = putChainWork(tx, block)
+		return err
+	}
+	c := b.Cursor()
+	for k,_:=c.First();k!=nil;k,_=c.Next(){
+		if string(k) == "l"{
+			continue
+		}
+		if err := index(k); err != nil{
+			return err
 		}
 	}
-	return Transaction{}, errors.New("transaction not found")
+	return nil
 }
 
-func (bc *Blockchain) FindUTXO() map[string]TXOutputs{
-	UTXO := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
+// FindTransaction returns the main chain transaction id, from the
+// transaction index when it is enabled
+func (bc *Blockchain) FindTransaction(id []byte) (Transaction, error){
+	var found *Transaction
+	indexed := false
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		indexed = hasTxIndex(tx)
+		blockHash, position, ok := lookupTx(tx, id)
+		if !ok{
+			return nil
+		}
+		t, _, err := indexedTransaction(tx, id, blockHash, position)
+		found = t
+		return err
+	})
+	if err != nil{
+		return Transaction{}, err
+	}
+	if found != nil{
+		return *found, nil
+	}
+	if indexed{
+		return Transaction{}, errors.New("transaction not found")
+	}
 	bci := bc.Iterator()
 	for {
 		block := bci.Next()
 		for _,tx := range block.Transactions{
-			id := hex.EncodeToString(tx.HashID)
-			Outputs:
-			for index,out := range tx.Vout{
-				if spentTXOs[id] != nil{
-					for _,preidx := range spentTXOs[id]{
-						if index == preidx{
-							continue Outputs
-						}
-					}
-				}
-				outs := UTXO[id]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[id] = outs
-				//UTXO[id].Outputs = append(UTXO[id].Outputs, out)
-			}
-			if tx.IsCoinbase() == false{
-				for _,in := range tx.Vin{
-					txid := hex.EncodeToString(in.TxID)
-					spentTXOs[txid] = append(spentTXOs[txid], in.PreOutIndex)
-				}
+			if bytes.Compare(tx.HashID, id) == 0{
+				return *tx, nil
 			}
 		}
 		if len(block.PreBlockHash) == 0{
 			break
 		}
 	}
-	return UTXO
+	return Transaction{}, errors.New("transaction not found")
 }
 
 func (bc *Blockchain) Iterator() *BlockchainIterator{
@@ -170,19 +360,31 @@ func (bc *Blockchain) Iterator() *BlockchainIterator{
 }
 
 func (bc *Blockchain) GetBestHeight() int{
-	var lastblock *Block
+	var lastheader *BlockHeader
 	err := bc.db.View(func(tx *bolt.Tx)error{
 		b := tx.Bucket([]byte(blocksBucket))
 		lasthash := b.Get([]byte("l"))
-		lastblockdata := b.Get(lasthash)
-		//lastblockdata := b.Get(bc.tail)
-		lastblock = DeserializeBlock(lastblockdata)
+		lastheader = getHeader(tx, lasthash)
 		return nil
 	})
 	if err != nil{
 		log.Panic(err)
 	}
-	return lastblock.Height
+	return lastheader.Height
+}
+
+// GetBestWork returns the cumulative work of the current best chain
+func (bc *Blockchain) GetBestWork() *big.Int{
+	var work *big.Int
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(blocksBucket))
+		work = chainWork(tx, b.Get([]byte("l")))
+		return nil
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return work
 }
 
 func (bc *Blockchain)GetBlock(blockhash []byte) (Block, error){
@@ -193,7 +395,11 @@ func (bc *Blockchain)GetBlock(blockhash []byte) (Block, error){
 		if blockdata == nil{
 			return errors.New("block not found")
 		}
-		block = *DeserializeBlock(blockdata)
+		stored, err := DeserializeBlock(blockdata)
+		if err != nil{
+			return err
+		}
+		block = *stored
 		return nil
 	})
 	if err != nil{
@@ -202,22 +408,29 @@ func (bc *Blockchain)GetBlock(blockhash []byte) (Block, error){
 	return block, nil
 }
 
-func (bc *Blockchain) GetBlockHashes() [][]byte{
-	var blockhashes [][]byte
-	bci := bc.Iterator()
-	for{
-		block := bci.Next()
-		blockhashes = append(blockhashes, block.Hash)
-		if len(block.PreBlockHash) == 0{
-			break
+// GetHeader returns the header of a stored block without decoding the block
+func (bc *Blockchain) GetHeader(blockhash []byte) (BlockHeader, error){
+	var header BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		h := getHeader(tx, blockhash)
+		if h == nil{
+			return errors.New("block not found")
 		}
-	}
-	return blockhashes
+		header = *h
+		return nil
+	})
+	return header, err
 }
 
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block{
+// MineBlock mines transactions on the current tip and stores the block
+// like AddBlock. Peer goroutines add blocks concurrently; if one moved the
+// tip while mining, the block is dropped and ErrStaleTip returned so the
+// caller can build a new one.
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error){
 	var lasthash []byte
 	var lastheight int
+	var bits uint32
+	var timestamp int64
 	for _,tx := range transactions{
 		if bc.VerifyTransaction(tx) != true{
 			log.Panic("invalid transaction")
@@ -225,60 +438,102 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block{
 	}
 	err := bc.db.View(func(tx *bolt.Tx)error{
 		b := tx.Bucket([]byte(blocksBucket))
-		lasthash = b.Get([]byte("l"))
-		lastblockdata := b.Get(lasthash)
-		lastblock := DeserializeBlock(lastblockdata)
-		lastheight = lastblock.Height
+		lasthash = append([]byte{}, b.Get([]byte("l"))...)
+		lastheader := getHeader(tx, lasthash)
+		lastheight = lastheader.Height
+		bits = nextBits(tx, lastheader)
+		timestamp = time.Now().Unix()
+		if mtp := medianTimePast(tx, lastheader); timestamp <= mtp{
+			timestamp = mtp + 1
+		}
 		return nil
 	})
 	if err != nil{
 		log.Panic(err)
 	}
-	newblock := NewBlock(transactions, lasthash, lastheight+1)
+	newblock := NewBlockAt(transactions, lasthash, lastheight+1, bits, timestamp)
 	err = bc.db.Update(func(tx *bolt.Tx)error{
 		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newblock.Hash, newblock.Serialize())
-		if err != nil{
-			log.Panic(err)
+		if !bytes.Equal(b.Get([]byte("l")), lasthash){
+			return ErrStaleTip
 		}
-		err = b.Put([]byte("l"), newblock.Hash)
-		if err != nil{
-			log.Panic(err)
+		_, err := bc.storeBlock(tx, newblock)
+		return err
+	})
+	if err != nil{
+		return nil, err
+	}
+	return newblock, nil
+}
+
+// CalcNextBits returns the target bits a block built on preBlockHash must use
+func (bc *Blockchain) CalcNextBits(preBlockHash []byte) uint32{
+	var bits uint32
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		if len(preBlockHash) == 0{
+			bits = nextBits(tx, nil)
+			return nil
 		}
-		bc.tail = newblock.Hash
+		parent := getHeader(tx, preBlockHash)
+		if parent == nil{
+			return errors.New("parent block not found")
+		}
+		bits = nextBits(tx, parent)
 		return nil
 	})
 	if err != nil{
 		log.Panic(err)
 	}
-	return newblock
+	return bits
 }
 
+// nextBits walks back from parent to the start of the current retarget
+// window when the next block lands on a retarget boundary
+func nextBits(tx *bolt.Tx, parent *BlockHeader) uint32{
+	if parent == nil{
+		return BigToCompact(powLimit)
+	}
+	if (parent.Height+1)%retargetInterval != 0{
+		return parent.Bits
+	}
+	first := parent
+	for first.Height > parent.Height-(retargetInterval-1) && first.Height > 0{
+		first = getHeader(tx, first.PreBlockHash)
+	}
+	return retarget(parent.Bits, parent.Timestamp-first.Timestamp)
+}
+
+// VerifyTransaction checks tx for inclusion in the next block
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool{
 	if tx.IsCoinbase(){
 		return true
 	}
-	preTXs := make(map[string]Transaction)
-	for _,in := range tx.Vin{
-		pretx, err := bc.FindTransaction(in.TxID)
-		if err != nil{
-			log.Panic(err)
-		}
-		preTXs[hex.EncodeToString(pretx.HashID)] = pretx
+	if bc.CheckLocks(tx) != nil{
+		return false
+	}
+	if (UTXOSet{bc}).CheckMaturity(tx, bc.GetBestHeight()+1) != nil{
+		return false
+	}
+	// the spent outputs come from the UTXO set rather than their
+	// transactions, which a node started from a snapshot may not have
+	prevOuts, err := UTXOSet{bc}.SpentOutputs(tx)
+	if err != nil{
+		return false
 	}
-	return tx.Verify(preTXs)
+	return tx.verifyScripts(prevOuts) == nil
 }
 
 func (bc *Blockchain) SignTransaction(tx *Transaction, private ecdsa.PrivateKey) {
-	preTXs := make(map[string]Transaction)
-	for _,in := range tx.Vin{
-		pretx, err := bc.FindTransaction(in.TxID)
+	prevOuts, err := UTXOSet{bc}.SpentOutputs(tx)
+	if err != nil{
+		log.Panic(err)
+	}
+	for inidx := range tx.Vin{
+		err := tx.SignInput(inidx, private, prevOuts[inidx], SigHashAll)
 		if err != nil{
 			log.Panic(err)
 		}
-		preTXs[hex.EncodeToString(pretx.HashID)] = pretx
 	}
-	tx.Sign(private, preTXs)
 }
 
 func dbExist(db string) bool{
@@ -15,8 +15,9 @@ func (bci *BlockchainIterator) Next() *Block{
 	err := bci.db.View(func(tx *bolt.Tx)error{
 		b := tx.Bucket([]byte(blocksBucket))
 		blockdata := b.Get(bci.currentHash)
-		block = DeserializeBlock(blockdata)
-		return nil
+		var err error
+		block, err = DeserializeBlock(blockdata)
+		return err
 	})
 	if err != nil{
 		log.Panic(err)
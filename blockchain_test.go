@@ -0,0 +1,59 @@
+package blockchain_practice
+
+import (
+	"os"
+	"testing"
+)
+
+// newTestChain creates a chain in a temporary directory whose genesis pays
+// a new wallet
+func newTestChain(t *testing.T) (*Blockchain, *Wallet){
+	dir, err := os.Getwd()
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil{
+		t.Fatal(err)
+	}
+	wallet := NewWallet()
+	bc := CreateBlockchainDB(string(wallet.GetAddress()), "test")
+	UTXOSet{bc}.Reindex()
+	t.Cleanup(func(){
+		bc.db.Close()
+		os.Chdir(dir)
+	})
+	return bc, wallet
+}
+
+// tipBlock returns the block at the tip of bc
+func tipBlock(t *testing.T, bc *Blockchain) *Block{
+	block, err := bc.GetBlock(bc.tail)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return &block
+}
+
+// mineOn mines a block on parent, targetBlockTime after it, paying the
+// subsidy to address
+func mineOn(bc *Blockchain, parent *Block, address string, txs ...*Transaction) *Block{
+	return mineAt(bc, parent, parent.Timestamp+targetBlockTime, address, txs...)
+}
+
+func mineAt(bc *Blockchain, parent *Block, timestamp int64, address string, txs ...*Transaction) *Block{
+	coinbase := NewCoinbaseTX(address, "", parent.Height+1, 0)
+	txs = append([]*Transaction{coinbase}, txs...)
+	return NewBlockAt(txs, parent.Hash, parent.Height+1, bc.CalcNextBits(parent.Hash), timestamp)
+}
+
+// extend mines n blocks on the tip of bc
+func extend(t *testing.T, bc *Blockchain, n int, address string) *Block{
+	tip := tipBlock(t, bc)
+	for i := 0; i < n; i++{
+		tip = mineOn(bc, tip, address)
+		if _, err := bc.AddBlock(tip); err != nil{
+			t.Fatal(err)
+		}
+	}
+	return tip
+}
@@ -6,6 +6,10 @@ import (
 	"os"
 	"log"
 	"strconv"
+	"strings"
+	"time"
+	"encoding/hex"
+	"io/ioutil"
 )
 
 type CLI struct{}
@@ -14,11 +18,24 @@ func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("---createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
 	fmt.Println("---createwallet - Generates a new key-pair and saves it into the wallet file")
+	fmt.Println("---createmultisig -m M -keys KEY,KEY,... - Create an M-of-N address over the KEYs, each a hex public key or an address of this wallet")
 	fmt.Println("---getbalance -address ADDRESS - Get balance of ADDRESS")
-	fmt.Println("---listaddresses - Lists all addresses from the wallet file")
+	fmt.Println("---listaddresses -pubkeys - Lists all addresses from the wallet file, with their public keys when -pubkeys is set")
 	fmt.Println("---printchain - Print all the blocks of the blockchain")
+	fmt.Println("---invalidateblock -hash HASH - Disconnect the main chain block HASH and the blocks above it, and never connect them again")
+	fmt.Println("---rollback -height HEIGHT - Disconnect blocks from the tip down to HEIGHT")
 	fmt.Println("---reindexutxo - Rebuilds the UTXO set")
-	fmt.Println("---send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
+	fmt.Println("---dumputxo -file FILE - Write the UTXO set, the tip and the headers leading to it to FILE")
+	fmt.Println("---loadutxo -file FILE - Start a chain holding only its genesis block from the snapshot in FILE. startnode then checks the snapshot against the historical blocks in the background")
+	fmt.Println("---reindex-tx - Builds the transaction index, turning it on if it was off")
+	fmt.Println("---send -from FROM -to TO -amount AMOUNT -fee FEE -feerate RATE -locktime LOCKTIME -mine - Send AMOUNT of coins from FROM address to TO, paying FEE, or RATE coins per 1000 bytes, to the miner. Mine on the same node, when -mine is set. With -locktime the transaction is only valid above that block height, or after that unix time when LOCKTIME >= 500000000.")
+	fmt.Println("---mine -address ADDRESS -blocks N - Mine N blocks holding only a coinbase paying ADDRESS, so coinbases mature without other transactions")
+	fmt.Println("---utxohash - Print the hash of the UTXO set, to compare with other nodes")
+	fmt.Println("---supply - Report the coins issued so far, from the UTXO set")
+	fmt.Println("---signtx -tx HEX - Add this wallet's signatures to a multisig transaction, and send it once it has enough")
+	fmt.Println("---listbanned - List the banned node addresses and hosts")
+	fmt.Println("---setban -addr ADDR -duration SECONDS -remove - Ban ADDR, a host:port or just a host to ban all its ports, for SECONDS, or lift its ban when -remove is set")
+	fmt.Println("---clearbanned - Lift all bans")
 	fmt.Println("---startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
 }
 
@@ -39,18 +56,47 @@ func (cli *CLI) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	rollbackCmd := flag.NewFlagSet("rollback", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindex-tx", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	signTxCmd := flag.NewFlagSet("signtx", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
+	utxoHashCmd := flag.NewFlagSet("utxohash", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	setBanCmd := flag.NewFlagSet("setban", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createMultisigM := createMultisigCmd.Int("m", 0, "Number of signatures required")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "Comma separated public keys or wallet addresses")
+	listAddressesPubKeys := listAddressesCmd.Bool("pubkeys", false, "Print the public key of each address")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "The block to invalidate")
+	rollbackHeight := rollbackCmd.Int("height", -1, "The height to roll back to")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "The file to write the snapshot to")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "The snapshot file to load")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendLockTime := sendCmd.Uint("locktime", 0, "Block height or unix time the transaction is locked until")
+	sendFee := sendCmd.Int("fee", 0, "Fee to pay the miner")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee to pay per 1000 bytes, instead of -fee")
+	mineAddress := mineCmd.String("address", "", "The address to send the block rewards to")
+	mineBlocks := mineCmd.Int("blocks", 1, "Number of blocks to mine")
+	signTxHex := signTxCmd.String("tx", "", "The partially signed transaction")
+	setBanAddr := setBanCmd.String("addr", "", "The address or host to ban")
+	setBanDuration := setBanCmd.Int("duration", int(banDuration/time.Second), "How many seconds the ban lasts")
+	setBanRemove := setBanCmd.Bool("remove", false, "Lift the ban instead")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
 
 	switch os.Args[1]{
@@ -69,6 +115,11 @@ func (cli *CLI) Run() {
 		if err != nil{
 			log.Panic(err)
 		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil{
@@ -79,16 +130,76 @@ func (cli *CLI) Run() {
 		if err != nil{
 			log.Panic(err)
 		}
+	case "invalidateblock":
+		err := invalidateBlockCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "rollback":
+		err := rollbackCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		if err != nil{
 			log.Panic(err)
 		}
+	case "reindex-tx":
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "dumputxo":
+		err := dumpUTXOCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "loadutxo":
+		err := loadUTXOCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil{
 			log.Panic(err)
 		}
+	case "mine":
+		err := mineCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "supply":
+		err := supplyCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "utxohash":
+		err := utxoHashCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "signtx":
+		err := signTxCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "setban":
+		err := setBanCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		if err != nil{
+			log.Panic(err)
+		}
 	case "startnode":
 		err := startNodeCmd.Parse(os.Args[2:])
 		if err != nil{
@@ -119,24 +230,109 @@ func (cli *CLI) Run() {
 		cli.createWallet(nodeID)
 	}
 
+	if createMultisigCmd.Parsed(){
+		if *createMultisigM <= 0 || *createMultisigKeys == ""{
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigM, strings.Split(*createMultisigKeys, ","), nodeID)
+	}
+
 	if listAddressesCmd.Parsed(){
-		cli.listAddresses(nodeID)
+		cli.listAddresses(nodeID, *listAddressesPubKeys)
 	}
 
 	if printChainCmd.Parsed(){
 		cli.printChain(nodeID)
 	}
 
+	if invalidateBlockCmd.Parsed(){
+		if *invalidateBlockHash == ""{
+			invalidateBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.invalidateBlock(*invalidateBlockHash, nodeID)
+	}
+
+	if rollbackCmd.Parsed(){
+		if *rollbackHeight < 0{
+			rollbackCmd.Usage()
+			os.Exit(1)
+		}
+		cli.rollback(*rollbackHeight, nodeID)
+	}
+
 	if reindexUTXOCmd.Parsed(){
 		cli.reindexUTXO(nodeID)
 	}
 
+	if reindexTxCmd.Parsed(){
+		cli.reindexTx(nodeID)
+	}
+
+	if dumpUTXOCmd.Parsed(){
+		if *dumpUTXOFile == ""{
+			dumpUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpUTXO(*dumpUTXOFile, nodeID)
+	}
+
+	if loadUTXOCmd.Parsed(){
+		if *loadUTXOFile == ""{
+			loadUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.loadUTXO(*loadUTXOFile, nodeID)
+	}
+
 	if sendCmd.Parsed(){
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0{
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendFeeRate < 0{
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		fee := Fee{*sendFee, *sendFeeRate}
+		cli.send(*sendFrom, *sendTo, *sendAmount, fee, uint32(*sendLockTime), nodeID, *sendMine)
+	}
+
+	if mineCmd.Parsed(){
+		if *mineAddress == "" || *mineBlocks <= 0{
+			mineCmd.Usage()
+			os.Exit(1)
+		}
+		cli.mine(*mineAddress, *mineBlocks, nodeID)
+	}
+
+	if supplyCmd.Parsed(){
+		cli.supply(nodeID)
+	}
+
+	if utxoHashCmd.Parsed(){
+		cli.utxoHash(nodeID)
+	}
+
+	if signTxCmd.Parsed(){
+		if *signTxHex == ""{
+			signTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signTx(*signTxHex, nodeID)
+	}
+
+	if listBannedCmd.Parsed(){
+		cli.listBanned(nodeID)
+	}
+
+	if setBanCmd.Parsed(){
+		if *setBanAddr == "" || *setBanDuration <= 0{
+			setBanCmd.Usage()
+			os.Exit(1)
+		}
+		cli.setBan(*setBanAddr, time.Duration(*setBanDuration)*time.Second, *setBanRemove, nodeID)
+	}
+
+	if clearBannedCmd.Parsed(){
+		cli.clearBanned(nodeID)
 	}
 
 	if startNodeCmd.Parsed(){
@@ -176,23 +372,55 @@ func (cli *CLI) getBalance(address, nodeID string) {
 	defer bc.db.Close()
 
 	balance := 0
-	pubkeyhash := Base58Decode([]byte(address))
-	pubkeyhash = pubkeyhash[1:len(pubkeyhash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubkeyhash)
+	lockScript, err := AddressLockScript(address)
+	if err != nil{
+		log.Panic(err)
+	}
+	UTXOs := UTXOSet.FindUTXO(lockScript)
 	for _,out := range UTXOs{
 		balance += out.Value
 	}
 	fmt.Printf("balance of %s: %d\n", address, balance)
 }
 
-func (cli *CLI) listAddresses(nodeID string){
+func (cli *CLI) createMultisig(m int, keys []string, nodeID string){
+	wallets, _ := NewWallets(nodeID)
+	var pubkeys [][]byte
+	for _,key := range keys{
+		if wallet, ok := wallets.Wallets[key]; ok{
+			pubkeys = append(pubkeys, wallet.PublicKey)
+			continue
+		}
+		pubkey, err := hex.DecodeString(key)
+		if err != nil{
+			log.Panic("not a public key or wallet address: ", key)
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+	address, err := wallets.CreateMultisig(m, pubkeys)
+	if err != nil{
+		log.Panic(err)
+	}
+	wallets.SaveToFile(nodeID)
+	fmt.Printf("your %d-of-%d address is %s\n", m, len(pubkeys), address)
+}
+
+func (cli *CLI) listAddresses(nodeID string, showPubKeys bool){
 	wallets, err := NewWallets(nodeID)
 	if err != nil{
 		log.Panic(err)
 	}
 	addresses := wallets.GetAddresses()
 	for _,address := range addresses{
-		fmt.Println(address)
+		if showPubKeys{
+			fmt.Printf("%s %x\n", address, wallets.GetWallet(address).PublicKey)
+		}else{
+			fmt.Println(address)
+		}
+	}
+	for _,address := range wallets.GetMultisigAddresses(){
+		ms, _ := wallets.GetMultisig(address)
+		fmt.Printf("%s (%d-of-%d multisig)\n", address, ms.M, len(ms.PubKeys))
 	}
 }
 
@@ -206,7 +434,7 @@ func (cli *CLI) printChain(nodeID string){
 		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("Prev. block: %x\n", block.PreBlockHash)
 		pow := NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
+		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate(bc)))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
@@ -225,7 +453,70 @@ func (cli *CLI) reindexUTXO(nodeID string) {
 	fmt.Printf("%d transactions reindexed", count)
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool){
+func (cli *CLI) invalidateBlock(hashHex, nodeID string){
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil{
+		log.Panic(err)
+	}
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	txs, err := bc.InvalidateBlock(hash)
+	if err != nil{
+		log.Panic(err)
+	}
+	fmt.Printf("tip is now at height %d, %d transactions unconfirmed\n", bc.GetBestHeight(), len(txs))
+}
+
+func (cli *CLI) rollback(height int, nodeID string){
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	txs, err := bc.Rollback(height)
+	if err != nil{
+		log.Panic(err)
+	}
+	fmt.Printf("tip is now at height %d, %d transactions unconfirmed\n", bc.GetBestHeight(), len(txs))
+}
+
+func (cli *CLI) reindexTx(nodeID string) {
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	count := bc.ReindexTransactions()
+	fmt.Printf("%d transactions indexed\n", count)
+}
+
+func (cli *CLI) dumpUTXO(file, nodeID string){
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	snapshot, err := bc.DumpUTXO()
+	if err != nil{
+		log.Panic(err)
+	}
+	err = ioutil.WriteFile(file, snapshot.Serialize(), 0644)
+	if err != nil{
+		log.Panic(err)
+	}
+	fmt.Printf("%d outputs at height %d, UTXO hash %x\n", snapshot.Count(), snapshot.Height(), snapshot.UTXOHash)
+}
+
+func (cli *CLI) loadUTXO(file, nodeID string){
+	data, err := ioutil.ReadFile(file)
+	if err != nil{
+		log.Panic(err)
+	}
+	snapshot, err := DeserializeSnapshot(data)
+	if err != nil{
+		log.Panic(err)
+	}
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	err = bc.LoadUTXO(snapshot)
+	if err != nil{
+		log.Panic(err)
+	}
+	fmt.Printf("%d outputs loaded at height %d, UTXO hash %x\n", snapshot.Count(), snapshot.Height(), snapshot.UTXOHash)
+}
+
+func (cli *CLI) send(from, to string, amount int, fee Fee, lockTime uint32, nodeID string, mineNow bool){
 	if !ValidateAddress(from){
 		log.Panic("invalid sender")
 	}
@@ -240,19 +531,157 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool){
 	if err != nil{
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	var tx *Transaction
+	if ms, ok := wallets.GetMultisig(from); ok{
+		tx = NewMultisigTransaction(ms, to, amount, fee, lockTime, &UTXOSet)
+		_, err = wallets.CosignMultisig(ms, tx)
+		if err != nil{
+			log.Panic(err)
+		}
+		if !ms.IsComplete(tx){
+			fmt.Printf("transaction needs more signatures, pass it to the co-signers:\n%x\n", tx.Serialize())
+			return
+		}
+	}else{
+		wallet := wallets.GetWallet(from)
+		tx = NewUTXOTransaction(&wallet, to, amount, fee, lockTime, &UTXOSet)
+	}
 	if mineNow{
-		cbtx := NewCoinbaseTX(from, "")
+		fees, err := UTXOSet.TransactionFee(tx)
+		if err != nil{
+			log.Panic(err)
+		}
+		cbtx := NewCoinbaseTX(from, "", bc.GetBestHeight()+1, fees)
 		txs := []*Transaction{cbtx, tx}
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		_, err = bc.MineBlock(txs)
+		if err != nil{
+			log.Panic(err)
+		}
 	}else{
-		sendTx(knownNodes[0], tx)
+		err = submitTx(seedNodes[0], tx)
+		if err != nil{
+			log.Panic(err)
+		}
 	}
 	fmt.Println("transaction success")
 }
 
+// mine extends the chain with blocks that only pay the subsidy to address
+func (cli *CLI) mine(address string, blocks int, nodeID string){
+	if !ValidateAddress(address){
+		log.Panic("invalid address")
+	}
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	for i := 0; i < blocks; i++{
+		cbtx := NewCoinbaseTX(address, "", bc.GetBestHeight()+1, 0)
+		block, err := bc.MineBlock([]*Transaction{cbtx})
+		if err != nil{
+			log.Panic(err)
+		}
+		fmt.Printf("mined block %d: %x\n", block.Height, block.Hash)
+	}
+}
+
+func (cli *CLI) supply(nodeID string){
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	UTXOSet := UTXOSet{bc}
+	height := bc.GetBestHeight()
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Supply: %d\n", UTXOSet.TotalSupply())
+	fmt.Printf("Scheduled: %d\n", ScheduledSupply(height))
+	fmt.Printf("Next subsidy: %d, halving every %d blocks\n", BlockSubsidy(height+1), HalvingInterval)
+	fmt.Printf("Max supply: %d\n", MaxSupply())
+}
+
+func (cli *CLI) utxoHash(nodeID string){
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	h := UTXOSet{bc}.Hash()
+	fmt.Printf("Block: %x\n", h.BlockHash)
+	fmt.Printf("Height: %d\n", h.Height)
+	fmt.Printf("UTXO hash: %x\n", h.Hash)
+}
+
+func (cli *CLI) signTx(txHex string, nodeID string){
+	data, err := hex.DecodeString(txHex)
+	if err != nil{
+		log.Panic(err)
+	}
+	tx, err := DeserializeTransaction(data)
+	if err != nil{
+		log.Panic(err)
+	}
+	if len(tx.Vin) == 0{
+		log.Panic("transaction has no inputs")
+	}
+	ms, err := multisigFromUnlock(tx.Vin[0].UnlockScript)
+	if err != nil{
+		log.Panic(err)
+	}
+	wallets, err := NewWallets(nodeID)
+	if err != nil{
+		log.Panic(err)
+	}
+	signed, err := wallets.CosignMultisig(ms, &tx)
+	if err != nil{
+		log.Panic(err)
+	}
+	if signed == 0{
+		log.Panic("this wallet holds none of the keys")
+	}
+	if !ms.IsComplete(&tx){
+		fmt.Printf("transaction needs more signatures, pass it to the co-signers:\n%x\n", tx.Serialize())
+		return
+	}
+	err = submitTx(seedNodes[0], &tx)
+	if err != nil{
+		log.Panic(err)
+	}
+	fmt.Println("transaction success")
+}
+
+func (cli *CLI) listBanned(nodeID string){
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	for _,ban := range bc.Bans(){
+		fmt.Printf("%s until %s: %s\n", ban.Addr, ban.Until.Format(time.RFC3339), ban.Reason)
+	}
+}
+
+func (cli *CLI) setBan(addr string, duration time.Duration, remove bool, nodeID string){
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	if remove{
+		found, err := bc.Unban(addr)
+		if err != nil{
+			log.Panic(err)
+		}
+		if !found{
+			log.Panicf("%s is not banned", addr)
+		}
+		fmt.Printf("%s unbanned\n", addr)
+		return
+	}
+	until := time.Now().Add(duration)
+	err := bc.Ban(addr, until, "banned manually")
+	if err != nil{
+		log.Panic(err)
+	}
+	fmt.Printf("%s banned until %s\n", addr, until.Format(time.RFC3339))
+}
+
+func (cli *CLI) clearBanned(nodeID string){
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+	err := bc.ClearBans()
+	if err != nil{
+		log.Panic(err)
+	}
+	fmt.Println("all bans lifted")
+}
+
 func (cli *CLI) startNode(nodeID, minerAddress string){
 	fmt.Printf("starting node %s\n", nodeID)
 	if len(minerAddress) > 0{
@@ -0,0 +1,150 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Blocks, transactions and outputs are encoded in a byte-exact format so
+// that hashes can be reproduced outside Go: integers are little-endian,
+// counts and byte strings are prefixed with a minimal unsigned varint, and
+// every encoding starts with a format version.
+const (
+	blockFormatVersion = 1
+	txFormatVersion = 2
+	maxVarBytes = 1 << 20
+)
+
+var (
+	ErrMalformed = errors.New("malformed encoding")
+	ErrTrailingData = errors.New("trailing data after encoding")
+	ErrOldTxFormat = errors.New("transaction in format 1, from before lock times")
+)
+
+type encoder struct{
+	buf bytes.Buffer
+}
+
+func (e *encoder) writeUint32(n uint32){
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], n)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) writeUint64(n uint64){
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) writeVarInt(n uint64){
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (e *encoder) writeVarBytes(data []byte){
+	e.writeVarInt(uint64(len(data)))
+	e.buf.Write(data)
+}
+
+func (e *encoder) Bytes() []byte{
+	return e.buf.Bytes()
+}
+
+// decoder reads what encoder writes. The first error sticks and every
+// later read returns zero values, so callers only check err at the end.
+type decoder struct{
+	data 	[]byte
+	err 	error
+}
+
+func (d *decoder) fail(format string, args ...interface{}){
+	if d.err == nil{
+		d.err = fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) next(n int) []byte{
+	if d.err != nil{
+		return nil
+	}
+	if n > len(d.data){
+		d.fail("need %d bytes, have %d", n, len(d.data))
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) readUint32() uint32{
+	b := d.next(4)
+	if b == nil{
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) readUint64() uint64{
+	b := d.next(8)
+	if b == nil{
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// readVarInt rejects over-long encodings so every value has exactly one
+// valid encoding
+func (d *decoder) readVarInt() uint64{
+	if d.err != nil{
+		return 0
+	}
+	n, size := binary.Uvarint(d.data)
+	if size <= 0{
+		d.fail("bad varint")
+		return 0
+	}
+	var b [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(b[:], n) != size{
+		d.fail("non-minimal varint")
+		return 0
+	}
+	d.data = d.data[size:]
+	return n
+}
+
+// readCount reads a count of items that each take at least minSize bytes
+func (d *decoder) readCount(minSize int) int{
+	n := d.readVarInt()
+	if n > uint64(len(d.data)/minSize){
+		d.fail("count %d exceeds remaining data", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readVarBytes() []byte{
+	n := d.readVarInt()
+	if n > maxVarBytes{
+		d.fail("byte string of %d bytes", n)
+		return nil
+	}
+	b := d.next(int(n))
+	if b == nil{
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// finish reports the first error, or trailing bytes nothing consumed
+func (d *decoder) finish() error{
+	if d.err != nil{
+		return d.err
+	}
+	if len(d.data) != 0{
+		return fmt.Errorf("%w: %d bytes", ErrTrailingData, len(d.data))
+	}
+	return nil
+}
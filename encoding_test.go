@@ -0,0 +1,136 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testTransaction() Transaction{
+	tx := Transaction{
+		nil,
+		[]TXInput{
+			{bytes.Repeat([]byte{1}, 32), 0, []byte{2, 3}, SequenceFinal},
+			{bytes.Repeat([]byte{4}, 32), 7, []byte{8}, RelativeLockBlocks(5)},
+		},
+		[]TXOutput{{10, []byte{5}}, {3, []byte{9}}},
+		600,
+	}
+	tx.HashID = tx.Hash()
+	return tx
+}
+
+func testBlock() *Block{
+	coinbase := Transaction{nil, []TXInput{{[]byte{}, -1, []byte("data"), SequenceFinal}}, []TXOutput{{10, []byte{6}}}, 0}
+	coinbase.HashID = coinbase.Hash()
+	tx := testTransaction()
+	header := BlockHeader{1600000000, bytes.Repeat([]byte{7}, 32), nil, 3, 0x1f00ffff, 42}
+	block := &Block{header, []*Transaction{&coinbase, &tx}, nil}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+	return block
+}
+
+func TestTransactionEncodingRoundTrip(t *testing.T){
+	tx := testTransaction()
+	data := tx.Serialize()
+	got, err := DeserializeTransaction(data)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tx){
+		t.Fatalf("got %+v, want %+v", got, tx)
+	}
+	if !bytes.Equal(got.Serialize(), data){
+		t.Fatal("encoding is not byte exact")
+	}
+}
+
+func TestBlockEncodingRoundTrip(t *testing.T){
+	block := testBlock()
+	data := block.Serialize()
+	got, err := DeserializeBlock(data)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Hash, block.Hash) || !bytes.Equal(got.MerkleRoot, block.HashTransactions()){
+		t.Fatal("header changed")
+	}
+	if len(got.Transactions) != 2 || !reflect.DeepEqual(*got.Transactions[1], *block.Transactions[1]){
+		t.Fatal("transactions changed")
+	}
+	if !bytes.Equal(got.Serialize(), data){
+		t.Fatal("encoding is not byte exact")
+	}
+}
+
+func TestDecodeRejectsTrailingData(t *testing.T){
+	tx := testTransaction()
+	if _, err := DeserializeTransaction(append(tx.Serialize(), 0)); !errors.Is(err, ErrTrailingData){
+		t.Errorf("transaction: %v", err)
+	}
+	if _, err := DeserializeBlock(append(testBlock().Serialize(), 0)); !errors.Is(err, ErrTrailingData){
+		t.Errorf("block: %v", err)
+	}
+	if _, err := DeserializeInput(append(tx.Vin[0].Serialize(), 0)); !errors.Is(err, ErrTrailingData){
+		t.Errorf("input: %v", err)
+	}
+	if _, err := DeserializeOutput(append(tx.Vout[0].Serialize(), 0)); !errors.Is(err, ErrTrailingData){
+		t.Errorf("output: %v", err)
+	}
+}
+
+func TestDecodeRejectsTruncatedData(t *testing.T){
+	data := testTransaction().Serialize()
+	for n := 0; n < len(data); n++{
+		if _, err := DeserializeTransaction(data[:n]); !errors.Is(err, ErrMalformed){
+			t.Fatalf("transaction cut to %d bytes: %v", n, err)
+		}
+	}
+	data = testBlock().Serialize()
+	for n := 0; n < len(data); n++{
+		if _, err := DeserializeBlock(data[:n]); !errors.Is(err, ErrMalformed){
+			t.Fatalf("block cut to %d bytes: %v", n, err)
+		}
+	}
+	if _, err := DeserializeHeader(make([]byte, headerLen-1)); !errors.Is(err, ErrMalformed){
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeRejectsMalformedData(t *testing.T){
+	data := testTransaction().Serialize()
+	// the version is 4 bytes and the input count the varint after it
+	tests := []struct{
+		name 	string
+		data 	[]byte
+		err 	error
+	}{
+		{"unknown version", append([]byte{9, 0, 0, 0}, data[4:]...), ErrMalformed},
+		{"old format", append([]byte{1, 0, 0, 0}, data[4:]...), ErrOldTxFormat},
+		{"non-minimal count", append(append(append([]byte{}, data[:4]...), data[4]|0x80, 0), data[5:]...), ErrMalformed},
+		{"count beyond data", append(append([]byte{}, data[:4]...), 0xff, 0x7f), ErrMalformed},
+	}
+	for _,test := range tests{
+		if _, err := DeserializeTransaction(test.data); !errors.Is(err, test.err){
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+	d := &decoder{data: []byte{0xff, 0xff, 0xff, 0x7f}}
+	if d.readVarBytes(); !errors.Is(d.finish(), ErrMalformed){
+		t.Error("oversized byte string accepted")
+	}
+}
+
+func TestVarIntEncoding(t *testing.T){
+	for _,n := range []uint64{0, 1, 127, 128, 16383, 16384, 1<<32, 1<<64 - 1}{
+		e := &encoder{}
+		e.writeVarInt(n)
+		d := &decoder{data: e.Bytes()}
+		got := d.readVarInt()
+		if err := d.finish(); err != nil || got != n{
+			t.Errorf("%d: got %d, %v", n, got, err)
+		}
+	}
+}
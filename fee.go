@@ -0,0 +1,37 @@
+package blockchain_practice
+
+// Fees are implicit: whatever a transaction's inputs hold beyond its
+// outputs goes to the miner, whose coinbase may claim the subsidy plus the
+// fees of the block. Fee rates are in coins per 1000 bytes of serialized
+// transaction.
+
+// Fee is what a new transaction pays: Amount, or when Rate is set, Rate
+// coins per 1000 bytes of its size
+type Fee struct{
+	Amount 	int
+	Rate 		int
+}
+
+// p2pkhUnlockSize is the size of a <signature> <pubkey> unlock script with
+// the longest DER signature
+const p2pkhUnlockSize = 1 + 72 + 1 + 1 + compressedPubKeyLen
+
+// feeForSize is the fee the rate asks of size bytes, rounded up
+func feeForSize(rate, size int) int{
+	return (rate*size + 999) / 1000
+}
+
+// FeeRate returns the rate tx pays with fee
+func FeeRate(tx *Transaction, fee int) int{
+	return fee * 1000 / len(tx.Serialize())
+}
+
+// estimateSize returns tx's size once every input has an unlock script of
+// unlockSize bytes
+func estimateSize(tx *Transaction, unlockSize int) int{
+	txcopy := tx.TrimmedCopy()
+	for i := range txcopy.Vin{
+		txcopy.Vin[i].UnlockScript = make([]byte, unlockSize)
+	}
+	return len(txcopy.Serialize())
+}
@@ -0,0 +1,8 @@
+module blockchain_practice
+
+go 1.20
+
+require (
+	github.com/boltdb/bolt v1.3.1
+	golang.org/x/crypto v0.9.0
+)
@@ -0,0 +1,179 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math/big"
+	"github.com/boltdb/bolt"
+)
+
+// maxHeadersPerMsg bounds a headers message. A peer that sends this many
+// is asked for the next batch. A peer whose headers do not connect to ours
+// is sent our locator again, up to maxUnconnectingHeaders times in a row;
+// an honest peer answers it with headers that do connect. Headers of a
+// branch with no more work than our chain are only kept while more of it
+// may follow, and at most maxSideHeaders of them per peer.
+const (
+	maxHeadersPerMsg = 2000
+	maxUnconnectingHeaders = 3
+	maxSideHeaders = 10 * maxHeadersPerMsg
+)
+
+var (
+	ErrUnconnectingHeaders = errors.New("headers do not connect to our chain")
+	ErrTooManySideHeaders = errors.New("too many headers with less work than our chain")
+	errLowWorkHeaders = errors.New("headers end with less work than our chain")
+)
+
+// BlockLocator lists hashes of the chain ending at from, or at the tip
+// when from is nil, going back to genesis: the first ten one block apart,
+// then twice as far apart each time. A peer answers with the headers after
+// the first hash it has on its main chain.
+func (bc *Blockchain) BlockLocator(from []byte) [][]byte{
+	var locator [][]byte
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		hash := from
+		if hash == nil{
+			hash = tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+		}
+		header := getHeader(tx, hash)
+		for step := 1;;{
+			locator = append(locator, append([]byte{}, hash...))
+			if header.Height == 0{
+				return nil
+			}
+			if len(locator) >= 10{
+				step *= 2
+			}
+			for i := 0; i < step && header.Height > 0; i++{
+				hash = header.PreBlockHash
+				header = getHeader(tx, hash)
+			}
+		}
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return locator
+}
+
+// HeadersAfter returns up to max main chain headers following the first
+// locator hash that is on the main chain, or following genesis if none is.
+// They are read forward from there, so a peer far behind costs no more
+// than one close to the tip.
+func (bc *Blockchain) HeadersAfter(locator [][]byte, max int) []*BlockHeader{
+	var headers []*BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		start := 0
+		for _,hash := range locator{
+			header := getHeader(tx, hash)
+			if header != nil && bytes.Equal(mainChainHash(tx, header.Height), hash){
+				start = header.Height
+				break
+			}
+		}
+		for height := start + 1; len(headers) < max; height++{
+			hash := mainChainHash(tx, height)
+			if hash == nil{
+				break
+			}
+			headers = append(headers, getHeader(tx, hash))
+		}
+		return nil
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return headers
+}
+
+// AddHeaders checks the timestamps and proof of work of headers, each the child of the one
+// before and the first the child of a stored header, and stores them so
+// their blocks can be downloaded. It returns the chain work at the last
+// and how many of them were new without leading past our chain's work.
+// A batch shorter than maxHeadersPerMsg ends the sender's chain, so if it
+// does not get past our work none of it is stored.
+func (bc *Blockchain) AddHeaders(headers []*BlockHeader) (*big.Int, int, error){
+	var work *big.Int
+	side := 0
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		parentHash := headers[0].PreBlockHash
+		parent := getHeader(tx, parentHash)
+		for _,h := range headers{
+			block := &Block{*h, nil, h.Hash()}
+			if parent == nil || !bytes.Equal(h.PreBlockHash, parentHash){
+				return blockError(block, ErrUnknownParent, "%x", h.PreBlockHash)
+			}
+			if isInvalid(tx, block.Hash) || isInvalid(tx, parentHash){
+				return blockError(block, ErrInvalidated, "")
+			}
+			if h.Height != parent.Height+1{
+				return blockError(block, ErrBadHeight, "got %d, parent is at %d", h.Height, parent.Height)
+			}
+			err := checkTimestamp(tx, parent, block)
+			if err != nil{
+				return err
+			}
+			err = checkProofOfWork(tx, parent, block)
+			if err != nil{
+				return err
+			}
+			if getHeader(tx, block.Hash) == nil{
+				err = putHeader(tx, block)
+				if err != nil{
+					return err
+				}
+				_, err = putChainWork(tx, block)
+				if err != nil{
+					return err
+				}
+				side++
+			}
+			parent, parentHash = h, block.Hash
+		}
+		work = chainWork(tx, parentHash)
+		if work.Cmp(chainWork(tx, tx.Bucket([]byte(blocksBucket)).Get([]byte("l")))) > 0{
+			side = 0
+			return nil
+		}
+		if side > 0 && len(headers) < maxHeadersPerMsg{
+			// rolls the new headers back
+			return errLowWorkHeaders
+		}
+		return nil
+	})
+	if err == errLowWorkHeaders{
+		return work, 0, nil
+	}
+	if err != nil{
+		return nil, 0, err
+	}
+	return work, side, nil
+}
+
+// MissingBlocks returns the headers of the blocks not stored yet on the
+// chain ending at hash, parent first
+func (bc *Blockchain) MissingBlocks(hash []byte) []*BlockHeader{
+	var missing []*BlockHeader
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(blocksBucket))
+		for b.Get(hash) == nil{
+			header := getHeader(tx, hash)
+			missing = append(missing, header)
+			hash = header.PreBlockHash
+		}
+		return nil
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	reverseHeaders(missing)
+	return missing
+}
+
+func reverseHeaders(headers []*BlockHeader){
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1{
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+}
@@ -0,0 +1,110 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"github.com/boltdb/bolt"
+)
+
+func TestHeadersAfter(t *testing.T){
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	tip := extend(t, bc, 30, address)
+	headers := bc.HeadersAfter(nil, maxHeadersPerMsg)
+	if len(headers) != 30 || headers[0].Height != 1 || !bytes.Equal(headers[29].Hash(), tip.Hash){
+		t.Fatal("headers after genesis", len(headers))
+	}
+	// the first locator hash on the main chain is where they start
+	parent, err := bc.GetBlock(headers[9].Hash())
+	if err != nil{
+		t.Fatal(err)
+	}
+	side := mineOn(bc, &parent, address)
+	if _, err := bc.AddBlock(side); err != nil{
+		t.Fatal(err)
+	}
+	got := bc.HeadersAfter([][]byte{side.Hash, headers[9].Hash()}, 5)
+	if len(got) != 5 || got[0].Height != 11 || got[4].Height != 15{
+		t.Fatal("headers after the locator", got)
+	}
+	if _, err := bc.Rollback(20); err != nil{
+		t.Fatal(err)
+	}
+	if got := bc.HeadersAfter([][]byte{headers[9].Hash()}, maxHeadersPerMsg); len(got) != 10{
+		t.Fatal("headers past the tip", len(got))
+	}
+	// a database from before the index gets it built when opened
+	var want [][]byte
+	err = bc.db.Update(func(tx *bolt.Tx)error{
+		for height := 0; mainChainHash(tx, height) != nil; height++{
+			want = append(want, append([]byte{}, mainChainHash(tx, height)...))
+		}
+		err := tx.DeleteBucket([]byte(mainChainBucket))
+		if err != nil{
+			return err
+		}
+		return indexMainChain(tx)
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	bc.db.View(func(tx *bolt.Tx)error{
+		for height, hash := range want{
+			if !bytes.Equal(mainChainHash(tx, height), hash){
+				t.Errorf("height %d", height)
+			}
+		}
+		if len(want) != 21 || mainChainHash(tx, len(want)) != nil{
+			t.Error("index length", len(want))
+		}
+		return nil
+	})
+}
+
+// branch returns the headers of n blocks on parent, below the first
+// retarget so they keep its bits
+func branch(parent *Block, n int, address string) []*BlockHeader{
+	var headers []*BlockHeader
+	for i := 0; i < n; i++{
+		coinbase := NewCoinbaseTX(address, "side", parent.Height+1, 0)
+		parent = NewBlockAt([]*Transaction{coinbase}, parent.Hash, parent.Height+1, parent.Bits, parent.Timestamp+targetBlockTime)
+		headers = append(headers, &parent.BlockHeader)
+	}
+	return headers
+}
+
+func TestAddHeadersSideBranch(t *testing.T){
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis := tipBlock(t, bc)
+	extend(t, bc, 4, address)
+	stored := func(h *BlockHeader) bool{
+		var header *BlockHeader
+		bc.db.View(func(tx *bolt.Tx)error{
+			header = getHeader(tx, h.Hash())
+			return nil
+		})
+		return header != nil
+	}
+	// a branch that ends without our chain's work is not kept
+	short := branch(genesis, 4, address)
+	work, side, err := bc.AddHeaders(short)
+	if err != nil || side != 0 || work.Cmp(bc.GetBestWork()) != 0{
+		t.Fatal(work, side, err)
+	}
+	if stored(short[0]){
+		t.Fatal("low work headers stored")
+	}
+	long := branch(genesis, 5, address)
+	work, side, err = bc.AddHeaders(long)
+	if err != nil || side != 0 || work.Cmp(bc.GetBestWork()) <= 0{
+		t.Fatal(work, side, err)
+	}
+	if !stored(long[0]) || !stored(long[4]){
+		t.Fatal("headers with more work not stored")
+	}
+	if banScore(fmt.Errorf("%w", ErrTooManySideHeaders)) < banThreshold{
+		t.Fatal("flooding side headers not banned")
+	}
+}
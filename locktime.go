@@ -0,0 +1,119 @@
+package blockchain_practice
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// A transaction with a non-zero LockTime can only go into a block above
+// that height, or when LockTime is at least lockTimeThreshold, a block
+// whose parent's median time past is later, unless all its inputs have
+// SequenceFinal.
+//
+// An input whose Sequence does not have sequenceLockDisable set is also
+// locked relative to the block that confirmed the output it spends: for
+// Sequence&sequenceLockMask blocks, or that many 512 second units when
+// sequenceLockTimeFlag is set, measured between the median times past
+// before the two blocks.
+//
+// Times are median times past rather than block timestamps, which the
+// miner of the block chooses and could set ahead to unlock outputs early.
+const (
+	SequenceFinal = 0xffffffff
+	sequenceLockDisable = 1 << 31
+	sequenceLockTimeFlag = 1 << 22
+	sequenceLockMask = 0x0000ffff
+	sequenceLockGranularity = 9
+)
+
+var ErrLocked = errors.New("transaction is time locked")
+
+// RelativeLockBlocks returns the Sequence locking an input for n blocks
+func RelativeLockBlocks(n int) uint32{
+	return uint32(n) & sequenceLockMask
+}
+
+// RelativeLockSeconds returns the Sequence locking an input for at least
+// the given number of seconds
+func RelativeLockSeconds(seconds int64) uint32{
+	units := (seconds + 1<<sequenceLockGranularity - 1) >> sequenceLockGranularity
+	return sequenceLockTimeFlag | uint32(units)&sequenceLockMask
+}
+
+// IsFinal reports whether tx's LockTime allows it into a block at height
+// whose parent has median time past time
+func (tx *Transaction) IsFinal(height int, time int64) bool{
+	if tx.LockTime == 0{
+		return true
+	}
+	limit := int64(height)
+	if tx.LockTime >= lockTimeThreshold{
+		limit = time
+	}
+	if int64(tx.LockTime) < limit{
+		return true
+	}
+	for _,in := range tx.Vin{
+		if in.Sequence != SequenceFinal{
+			return false
+		}
+	}
+	return true
+}
+
+// CheckLocks returns an error unless tx's lock time and relative locks let
+// it into the next block
+func (bc *Blockchain) CheckLocks(tx *Transaction) error{
+	return bc.db.View(func(dbtx *bolt.Tx)error{
+		tip := dbtx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+		header := getHeader(dbtx, tip)
+		return checkLocks(dbtx, tx, tip, header.Height+1, nil)
+	})
+}
+
+// checkLocks checks tx for a block at height on top of tip. Outputs of the
+// transactions in inBlock are confirmed by that block.
+func checkLocks(dbtx *bolt.Tx, tx *Transaction, tip []byte, height int, inBlock map[string]*Transaction) error{
+	time := medianTimePast(dbtx, getHeader(dbtx, tip))
+	if !tx.IsFinal(height, time){
+		return fmt.Errorf("%w: until %d", ErrLocked, tx.LockTime)
+	}
+	for inidx, in := range tx.Vin{
+		if tx.IsCoinbase() || in.Sequence&sequenceLockDisable != 0{
+			continue
+		}
+		prevHeight, prevTime := height, time
+		if _, ok := inBlock[hex.EncodeToString(in.TxID)]; !ok{
+			entry, ok := findUnspentOutput(dbtx.Bucket([]byte(utxoBucket)), in.TxID, in.PreOutIndex)
+			if !ok{
+				return fmt.Errorf("%w: input %d spends an unconfirmed output", ErrLocked, inidx)
+			}
+			header := ancestorHeader(dbtx, tip, entry.Height)
+			prevHeight, prevTime = header.Height, header.Timestamp
+			if parent := getHeader(dbtx, header.PreBlockHash); parent != nil{
+				prevTime = medianTimePast(dbtx, parent)
+			}
+		}
+		lock := int64(in.Sequence & sequenceLockMask)
+		if in.Sequence&sequenceLockTimeFlag != 0{
+			if time-prevTime < lock<<sequenceLockGranularity{
+				return fmt.Errorf("%w: input %d for %d seconds", ErrLocked, inidx, lock<<sequenceLockGranularity)
+			}
+		}else if int64(height-prevHeight) < lock{
+			return fmt.Errorf("%w: input %d for %d blocks", ErrLocked, inidx, lock)
+		}
+	}
+	return nil
+}
+
+// ancestorHeader returns the header at height on the chain ending at tip,
+// reading only headers
+func ancestorHeader(dbtx *bolt.Tx, tip []byte, height int) *BlockHeader{
+	header := getHeader(dbtx, tip)
+	for header.Height > height{
+		header = getHeader(dbtx, header.PreBlockHash)
+	}
+	return header
+}
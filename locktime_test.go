@@ -0,0 +1,112 @@
+package blockchain_practice
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsFinal(t *testing.T){
+	tx := testTransaction()
+	tx.LockTime = 100
+	if tx.IsFinal(100, 0) || !tx.IsFinal(101, 0){
+		t.Error("height lock")
+	}
+	tx.LockTime = lockTimeThreshold + 100
+	if tx.IsFinal(1<<30, lockTimeThreshold+100) || !tx.IsFinal(0, lockTimeThreshold+101){
+		t.Error("time lock")
+	}
+	for i := range tx.Vin{
+		tx.Vin[i].Sequence = SequenceFinal
+	}
+	if !tx.IsFinal(0, 0){
+		t.Error("final inputs still locked")
+	}
+}
+
+func TestRelativeLockSeconds(t *testing.T){
+	for seconds, units := range map[int64]uint32{1: 1, 512: 1, 513: 2, 1024: 2}{
+		if got := RelativeLockSeconds(seconds); got != sequenceLockTimeFlag|units{
+			t.Errorf("%d seconds: got %x", seconds, got)
+		}
+	}
+}
+
+// mineSpaced adds n blocks step seconds apart on the tip of bc
+func mineSpaced(t *testing.T, bc *Blockchain, n int, step int64, address string) *Block{
+	tip := tipBlock(t, bc)
+	for i := 0; i < n; i++{
+		tip = mineAt(bc, tip, tip.Timestamp+step, address)
+		if _, err := bc.AddBlock(tip); err != nil{
+			t.Fatal(err)
+		}
+	}
+	return tip
+}
+
+func TestTimeLockUsesMedianTimePast(t *testing.T){
+	old := CoinbaseMaturity
+	CoinbaseMaturity = 1
+	defer func(){ CoinbaseMaturity = old }()
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis := tipBlock(t, bc)
+	tip := mineSpaced(t, bc, medianTimeBlocks, targetBlockTime, address)
+	lockTime := genesis.Timestamp + 10*targetBlockTime
+	tx := NewUTXOTransaction(wallet, address, 3, Fee{}, uint32(lockTime), &UTXOSet{bc})
+	if err := bc.CheckLocks(tx); !errors.Is(err, ErrLocked){
+		t.Fatal("locked transaction passed", err)
+	}
+	// the block's own timestamp is past the lock, its median time past is not
+	early := mineAt(bc, tip, lockTime+targetBlockTime, address, tx)
+	if _, err := bc.AddBlock(early); !errors.Is(err, ErrInvalidTx){
+		t.Fatal("block timestamp unlocked the transaction", err)
+	}
+	tip = mineSpaced(t, bc, medianTimeBlocks/2+1, targetBlockTime, address)
+	if err := bc.CheckLocks(tx); err != nil{
+		t.Fatal(err)
+	}
+	if _, err := bc.AddBlock(mineOn(bc, tip, address, tx)); err != nil{
+		t.Fatal(err)
+	}
+}
+
+func TestRelativeLocks(t *testing.T){
+	old := CoinbaseMaturity
+	CoinbaseMaturity = 1
+	defer func(){ CoinbaseMaturity = old }()
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	tip := mineSpaced(t, bc, 1, targetBlockTime, address)
+	funding := NewUTXOTransaction(wallet, address, 3, Fee{}, 0, &UTXOSet{bc})
+	tip = mineOn(bc, tip, address, funding)
+	if _, err := bc.AddBlock(tip); err != nil{
+		t.Fatal(err)
+	}
+	spend := func(sequence uint32) *Transaction{
+		tx := &Transaction{nil, []TXInput{{funding.HashID, 0, nil, sequence}}, []TXOutput{*NewTXOutput(address, 3)}, 0}
+		tx.HashID = tx.Hash()
+		if err := tx.SignInput(0, wallet.PrivateKey, funding.Vout[0], SigHashAll); err != nil{
+			t.Fatal(err)
+		}
+		return tx
+	}
+	byBlocks, bySeconds := spend(RelativeLockBlocks(3)), spend(RelativeLockSeconds(512))
+	if _, err := bc.AddBlock(mineOn(bc, tip, address, byBlocks)); !errors.Is(err, ErrInvalidTx){
+		t.Fatal("block lock ignored", err)
+	}
+	tip = mineSpaced(t, bc, 2, targetBlockTime, address)
+	if err := bc.CheckLocks(byBlocks); err != nil{
+		t.Fatal(err)
+	}
+	// a single block far ahead does not move the median time past enough
+	if _, err := bc.AddBlock(mineAt(bc, tip, tip.Timestamp+600, address, bySeconds)); !errors.Is(err, ErrInvalidTx){
+		t.Fatal("time lock ignored", err)
+	}
+	tip = mineSpaced(t, bc, medianTimeBlocks, 100, address)
+	if err := bc.CheckLocks(bySeconds); err != nil{
+		t.Fatal(err)
+	}
+	if _, err := bc.AddBlock(mineOn(bc, tip, address, bySeconds)); err != nil{
+		t.Fatal(err)
+	}
+}
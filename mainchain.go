@@ -0,0 +1,68 @@
+package blockchain_practice
+
+import (
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+)
+
+// The main chain index maps each height up to the tip to the hash of the
+// main chain block there, so the chain can be walked forward. Blocks are
+// indexed as they are connected and unindexed as they are disconnected;
+// databases from before it get it built when they are opened.
+const mainChainBucket = "mainchain"
+
+func heightKey(height int) []byte{
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(height))
+	return key
+}
+
+// mainChainHash returns the hash of the main chain block at height, or
+// nil above the tip
+func mainChainHash(tx *bolt.Tx, height int) []byte{
+	b := tx.Bucket([]byte(mainChainBucket))
+	if b == nil{
+		return nil
+	}
+	return b.Get(heightKey(height))
+}
+
+// setMainChain records hash as the main chain block at height, if there is
+// an index
+func setMainChain(tx *bolt.Tx, height int, hash []byte) error{
+	b := tx.Bucket([]byte(mainChainBucket))
+	if b == nil{
+		return nil
+	}
+	return b.Put(heightKey(height), hash)
+}
+
+// unsetMainChain takes the main chain block at height out of the index
+func unsetMainChain(tx *bolt.Tx, height int) error{
+	b := tx.Bucket([]byte(mainChainBucket))
+	if b == nil{
+		return nil
+	}
+	return b.Delete(heightKey(height))
+}
+
+// indexMainChain builds the index from the headers of the chain ending at
+// the tip if the database has none
+func indexMainChain(tx *bolt.Tx) error{
+	if tx.Bucket([]byte(mainChainBucket)) != nil{
+		return nil
+	}
+	b, err := tx.CreateBucket([]byte(mainChainBucket))
+	if err != nil{
+		return err
+	}
+	for hash := tx.Bucket([]byte(blocksBucket)).Get([]byte("l")); len(hash) > 0;{
+		header := getHeader(tx, hash)
+		err = b.Put(heightKey(header.Height), hash)
+		if err != nil{
+			return err
+		}
+		hash = header.PreBlockHash
+	}
+	return nil
+}
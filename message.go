@@ -0,0 +1,97 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message on a peer connection is framed by a 24 byte header: the
+// network magic, the command padded with zeros to commandLength bytes,
+// the payload length and the first 4 bytes of the payload's double sha256,
+// all little-endian. A reader can then tell where each message ends and
+// drop the connection on a corrupted or truncated one. The magic is our
+// own so nodes of other networks, Bitcoin's among them, are told apart
+// at the first message.
+const (
+	networkMagic = 0x3e8a51c7
+	messageHeaderLen = 4 + commandLength + 4 + 4
+	maxMessagePayload = 32 << 20
+	// nothing sent before the handshake is done needs more than this
+	maxHandshakePayload = 4 << 10
+)
+
+var (
+	ErrBadMagic = errors.New("wrong network magic")
+	ErrBadCommand = errors.New("malformed command")
+	ErrOversizedMessage = errors.New("message payload too large")
+	ErrBadChecksum = errors.New("payload checksum mismatch")
+)
+
+type message struct{
+	command 	string
+	payload 	[]byte
+}
+
+func messageChecksum(payload []byte) []byte{
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+func (m *message) Serialize() []byte{
+	data := make([]byte, messageHeaderLen, messageHeaderLen+len(m.payload))
+	binary.LittleEndian.PutUint32(data[0:4], networkMagic)
+	copy(data[4:4+commandLength], commandToBytes(m.command))
+	binary.LittleEndian.PutUint32(data[4+commandLength:8+commandLength], uint32(len(m.payload)))
+	copy(data[8+commandLength:], messageChecksum(m.payload))
+	return append(data, m.payload...)
+}
+
+func writeMessage(w io.Writer, m *message) error{
+	_, err := w.Write(m.Serialize())
+	return err
+}
+
+// readMessage reads one framed message. A connection closed between
+// messages gives io.EOF, one closed inside a message io.ErrUnexpectedEOF.
+func readMessage(r io.Reader) (*message, error){
+	return readMessageLimit(r, maxMessagePayload)
+}
+
+// readMessageLimit reads one framed message with a payload of at most
+// limit bytes. The payload is buffered as it arrives, so a length in the
+// header costs nothing until the peer actually sends that much.
+func readMessageLimit(r io.Reader, limit uint32) (*message, error){
+	header := make([]byte, messageHeaderLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil{
+		return nil, err
+	}
+	if magic := binary.LittleEndian.Uint32(header[0:4]); magic != networkMagic{
+		return nil, fmt.Errorf("%w: %08x", ErrBadMagic, magic)
+	}
+	command, err := bytesToCommand(header[4:4+commandLength])
+	if err != nil{
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[4+commandLength:8+commandLength])
+	if length > limit{
+		return nil, fmt.Errorf("%w: %s of %d bytes", ErrOversizedMessage, command, length)
+	}
+	var payload bytes.Buffer
+	_, err = io.CopyN(&payload, r, int64(length))
+	if err == io.EOF{
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil{
+		return nil, err
+	}
+	if !bytes.Equal(messageChecksum(payload.Bytes()), header[8+commandLength:]){
+		return nil, fmt.Errorf("%w: %s", ErrBadChecksum, command)
+	}
+	return &message{command, payload.Bytes()}, nil
+}
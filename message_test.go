@@ -0,0 +1,72 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T){
+	var stream bytes.Buffer
+	sent := []*message{{"version", []byte("payload")}, {"verack", nil}, {"getheaders", bytes.Repeat([]byte{1}, 1000)}}
+	for _,m := range sent{
+		if err := writeMessage(&stream, m); err != nil{
+			t.Fatal(err)
+		}
+	}
+	for _,m := range sent{
+		got, err := readMessage(&stream)
+		if err != nil{
+			t.Fatal(err)
+		}
+		if got.command != m.command || !bytes.Equal(got.payload, m.payload){
+			t.Fatalf("got %s %x, want %s %x", got.command, got.payload, m.command, m.payload)
+		}
+	}
+	if _, err := readMessage(&stream); err != io.EOF{
+		t.Fatalf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+func TestReadMessageRejects(t *testing.T){
+	data := (&message{"tx", []byte("payload")}).Serialize()
+	corrupt := func(at int) []byte{
+		bad := append([]byte{}, data...)
+		bad[at] ^= 1
+		return bad
+	}
+	oversized := append([]byte{}, data[:messageHeaderLen]...)
+	binary.LittleEndian.PutUint32(oversized[4+commandLength:], maxMessagePayload+1)
+	tests := []struct{
+		name 	string
+		data 	[]byte
+		err 	error
+	}{
+		{"bad magic", corrupt(0), ErrBadMagic},
+		{"text after command padding", corrupt(4+commandLength-1), ErrBadCommand},
+		{"empty command", append(append(append([]byte{}, data[:4]...), make([]byte, commandLength)...), data[4+commandLength:]...), ErrBadCommand},
+		{"bad checksum", corrupt(8+commandLength), ErrBadChecksum},
+		{"corrupted payload", corrupt(len(data)-1), ErrBadChecksum},
+		{"oversized", oversized, ErrOversizedMessage},
+		{"truncated header", data[:messageHeaderLen-1], io.ErrUnexpectedEOF},
+		{"truncated payload", data[:len(data)-1], io.ErrUnexpectedEOF},
+		{"header only", data[:messageHeaderLen], io.ErrUnexpectedEOF},
+	}
+	for _,test := range tests{
+		if _, err := readMessage(bytes.NewReader(test.data)); !errors.Is(err, test.err){
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReadMessageLimit(t *testing.T){
+	data := (&message{"version", make([]byte, maxHandshakePayload+1)}).Serialize()
+	if _, err := readMessageLimit(bytes.NewReader(data), maxHandshakePayload); !errors.Is(err, ErrOversizedMessage){
+		t.Fatal("oversized handshake message accepted", err)
+	}
+	if _, err := readMessage(bytes.NewReader(data)); err != nil{
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+package blockchain_practice
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// MuHash is a hash of a multiset: elements are mapped to numbers modulo a
+// 3072 bit prime and multiplied together, so elements can be added and
+// removed in any order and equal sets always hash the same. Removals are
+// multiplied into a separate denominator, which keeps each update to one
+// multiplication and leaves the one inverse to Digest.
+type MuHash struct{
+	numerator 		*big.Int
+	denominator 	*big.Int
+}
+
+const muHashBytes = 384
+
+// muHashPrime is 2^3072 - 1103717, the largest 3072 bit safe prime
+var muHashPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+var ErrBadMuHash = errors.New("malformed muhash state")
+
+func NewMuHash() *MuHash{
+	return &MuHash{big.NewInt(1), big.NewInt(1)}
+}
+
+// muHashElement expands the sha256 of data to a number below the prime
+func muHashElement(data []byte) *big.Int{
+	seed := sha256.Sum256(data)
+	var buf []byte
+	for i:=0;len(buf)<muHashBytes;i++{
+		block := sha256.Sum256(append(seed[:], byte(i)))
+		buf = append(buf, block[:]...)
+	}
+	n := new(big.Int).SetBytes(buf[:muHashBytes])
+	return n.Mod(n, muHashPrime)
+}
+
+func (h *MuHash) Add(data []byte){
+	h.numerator.Mul(h.numerator, muHashElement(data))
+	h.numerator.Mod(h.numerator, muHashPrime)
+}
+
+func (h *MuHash) Remove(data []byte){
+	h.denominator.Mul(h.denominator, muHashElement(data))
+	h.denominator.Mod(h.denominator, muHashPrime)
+}
+
+// Digest returns the sha256 of the set's value
+func (h *MuHash) Digest() []byte{
+	n := new(big.Int).ModInverse(h.denominator, muHashPrime)
+	n.Mul(n, h.numerator)
+	n.Mod(n, muHashPrime)
+	digest := sha256.Sum256(n.FillBytes(make([]byte, muHashBytes)))
+	return digest[:]
+}
+
+func (h *MuHash) Serialize() []byte{
+	data := make([]byte, 2*muHashBytes)
+	h.numerator.FillBytes(data[:muHashBytes])
+	h.denominator.FillBytes(data[muHashBytes:])
+	return data
+}
+
+func DeserializeMuHash(data []byte) (*MuHash, error){
+	if len(data) != 2*muHashBytes{
+		return nil, ErrBadMuHash
+	}
+	h := &MuHash{new(big.Int).SetBytes(data[:muHashBytes]), new(big.Int).SetBytes(data[muHashBytes:])}
+	if h.numerator.Cmp(muHashPrime) >= 0 || h.denominator.Sign() == 0 || h.denominator.Cmp(muHashPrime) >= 0{
+		return nil, ErrBadMuHash
+	}
+	return h, nil
+}
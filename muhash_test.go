@@ -0,0 +1,76 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMuHashOrderIndependence(t *testing.T){
+	var elements [][]byte
+	for i := 0; i < 5; i++{
+		elements = append(elements, []byte(fmt.Sprintf("element %d", i)))
+	}
+	forward, backward := NewMuHash(), NewMuHash()
+	for i := range elements{
+		forward.Add(elements[i])
+		backward.Add(elements[len(elements)-1-i])
+	}
+	if !bytes.Equal(forward.Digest(), backward.Digest()){
+		t.Fatal("digest depends on insertion order")
+	}
+	// removing an element, even before it was added, leaves the set
+	// without it
+	removed := NewMuHash()
+	removed.Remove(elements[2])
+	for _,e := range elements{
+		removed.Add(e)
+	}
+	without := NewMuHash()
+	for i, e := range elements{
+		if i != 2{
+			without.Add(e)
+		}
+	}
+	if !bytes.Equal(removed.Digest(), without.Digest()){
+		t.Fatal("removal does not undo an addition")
+	}
+	if bytes.Equal(forward.Digest(), without.Digest()){
+		t.Fatal("different sets hash the same")
+	}
+	empty := NewMuHash()
+	empty.Add(elements[0])
+	empty.Remove(elements[0])
+	if !bytes.Equal(empty.Digest(), NewMuHash().Digest()){
+		t.Fatal("adding and removing an element changed the empty set")
+	}
+}
+
+func TestMuHashSerialize(t *testing.T){
+	h := NewMuHash()
+	h.Add([]byte("a"))
+	h.Remove([]byte("b"))
+	data := h.Serialize()
+	got, err := DeserializeMuHash(data)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Digest(), h.Digest()) || !bytes.Equal(got.Serialize(), data){
+		t.Fatal("state changed")
+	}
+	if _, err := DeserializeMuHash(data[1:]); !errors.Is(err, ErrBadMuHash){
+		t.Fatal("short state accepted")
+	}
+	if _, err := DeserializeMuHash(append(data, 0)); !errors.Is(err, ErrBadMuHash){
+		t.Fatal("long state accepted")
+	}
+	zero := append(append([]byte{}, data[:muHashBytes]...), make([]byte, muHashBytes)...)
+	if _, err := DeserializeMuHash(zero); !errors.Is(err, ErrBadMuHash){
+		t.Fatal("zero denominator accepted")
+	}
+	large := append(bytes.Repeat([]byte{0xff}, muHashBytes), data[muHashBytes:]...)
+	if _, err := DeserializeMuHash(large); !errors.Is(err, ErrBadMuHash){
+		t.Fatal("numerator above the prime accepted")
+	}
+}
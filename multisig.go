@@ -0,0 +1,167 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var ErrNotCosigner = errors.New("key is not part of the multisig")
+
+// Multisig describes an m-of-n address. Coins sent to it are locked to the
+// hash of its redeem script, <m> <pubkey>... <n> OP_CHECKMULTISIG.
+type Multisig struct{
+	M 				int
+	PubKeys 		[][]byte
+}
+
+func NewMultisig(m int, pubkeys [][]byte) (*Multisig, error){
+	_, err := NewMultisigScript(m, pubkeys)
+	if err != nil{
+		return nil, err
+	}
+	return &Multisig{m, pubkeys}, nil
+}
+
+func (ms Multisig) RedeemScript() []byte{
+	script, err := NewMultisigScript(ms.M, ms.PubKeys)
+	if err != nil{
+		log.Panic(err)
+	}
+	return script
+}
+
+func (ms Multisig) GetAddress() []byte{
+	return encodeAddress(scriptHashVersion, HashPubKey(ms.RedeemScript()))
+}
+
+// multisigFromUnlock recovers the Multisig whose redeem script ends a
+// (partial) unlock script
+func multisigFromUnlock(unlock []byte) (*Multisig, error){
+	ops, err := parseScript(unlock)
+	if err != nil{
+		return nil, err
+	}
+	if len(ops) == 0{
+		return nil, fmt.Errorf("%w: no redeem script", ErrMalformedScript)
+	}
+	m, pubkeys, err := parseMultisigScript(ops[len(ops)-1].data)
+	if err != nil{
+		return nil, err
+	}
+	return &Multisig{m, pubkeys}, nil
+}
+
+// Until an input has M signatures its unlock script holds one slot per
+// key, empty for keys that have not signed yet, followed by the redeem
+// script. Once complete it becomes <sig>... <redeem> with exactly M
+// signatures in key order, which is what OP_CHECKMULTISIG expects.
+
+// unsignedUnlock returns the unlock script of an input nobody has signed
+func (ms Multisig) unsignedUnlock() []byte{
+	var script []byte
+	for range ms.PubKeys{
+		script = pushData(script, nil)
+	}
+	return pushData(script, ms.RedeemScript())
+}
+
+// slots returns the signature slots of a partial unlock script, and
+// whether it is already complete
+func (ms Multisig) slots(unlock []byte) ([][]byte, bool, error){
+	ops, err := parseScript(unlock)
+	if err != nil{
+		return nil, false, err
+	}
+	if len(ops) == 0 || !bytes.Equal(ops[len(ops)-1].data, ms.RedeemScript()){
+		return nil, false, fmt.Errorf("%w: unlock script is not for this multisig", ErrMalformedScript)
+	}
+	var slots [][]byte
+	for _,op := range ops[:len(ops)-1]{
+		slots = append(slots, op.data)
+	}
+	switch len(slots){
+	case len(ms.PubKeys):
+		return slots, ms.signatures(slots) >= ms.M, nil
+	case ms.M:
+		return slots, true, nil
+	}
+	return nil, false, fmt.Errorf("%w: %d signature slots", ErrMalformedScript, len(slots))
+}
+
+func (ms Multisig) signatures(slots [][]byte) int{
+	count := 0
+	for _,slot := range slots{
+		if len(slot) > 0{
+			count++
+		}
+	}
+	return count
+}
+
+// Sign adds private's signature to every input of tx, all of which must
+// spend outputs of this multisig. Once an input has M signatures its
+// unlock script is finalized.
+func (ms Multisig) Sign(tx *Transaction, private ecdsa.PrivateKey) error{
+	pubkey := encodePubKey(&private.PublicKey)
+	keyidx := -1
+	for i, key := range ms.PubKeys{
+		if bytes.Equal(key, pubkey){
+			keyidx = i
+		}
+	}
+	if keyidx < 0{
+		return ErrNotCosigner
+	}
+	// signatures commit to the redeem script in place of the lock script
+	redeemOut := TXOutput{LockScript: ms.RedeemScript()}
+	for inidx := range tx.Vin{
+		slots, complete, err := ms.slots(tx.Vin[inidx].UnlockScript)
+		if err != nil{
+			return err
+		}
+		if complete && len(slots) == ms.M{
+			continue
+		}
+		signature, err := tx.CreateSignature(inidx, private, redeemOut, SigHashAll)
+		if err != nil{
+			return err
+		}
+		slots[keyidx] = signature
+		var script []byte
+		if ms.signatures(slots) < ms.M{
+			for _,slot := range slots{
+				script = pushData(script, slot)
+			}
+		}else{
+			taken := 0
+			for _,slot := range slots{
+				if len(slot) > 0 && taken < ms.M{
+					script = pushData(script, slot)
+					taken++
+				}
+			}
+		}
+		tx.Vin[inidx].UnlockScript = pushData(script, redeemOut.LockScript)
+	}
+	return nil
+}
+
+// unlockSize is the size of a complete unlock script with the longest
+// signatures
+func (ms Multisig) unlockSize() int{
+	return ms.M*(1+73) + len(pushData(nil, ms.RedeemScript()))
+}
+
+// IsComplete reports whether every input of tx has enough signatures
+func (ms Multisig) IsComplete(tx *Transaction) bool{
+	for _,in := range tx.Vin{
+		slots, complete, err := ms.slots(in.UnlockScript)
+		if err != nil || !complete || len(slots) != ms.M{
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	maxOrphanBlocks = 100
+	orphanTTL = time.Hour
+)
+
+type orphanBlock struct{
+	block 		*Block
+	expires 	time.Time
+}
+
+// orphanPool keeps blocks whose parent we have not seen yet, keyed by the
+// missing parent so they can be connected as soon as it arrives
+type orphanPool struct{
+	mu 				sync.Mutex
+	orphans 		map[string]*orphanBlock
+	byParent 		map[string][]*orphanBlock
+}
+
+var orphans = newOrphanPool()
+
+func newOrphanPool() *orphanPool{
+	return &orphanPool{
+		orphans: make(map[string]*orphanBlock),
+		byParent: make(map[string][]*orphanBlock),
+	}
+}
+
+// add stores block, evicting expired orphans first and then the one
+// closest to expiry if the pool is still full
+func (p *orphanPool) add(block *Block){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := hex.EncodeToString(block.Hash)
+	if p.orphans[id] != nil{
+		return
+	}
+	now := time.Now()
+	for _,ob := range p.orphans{
+		if now.After(ob.expires){
+			p.remove(ob)
+		}
+	}
+	if len(p.orphans) >= maxOrphanBlocks{
+		var oldest *orphanBlock
+		for _,ob := range p.orphans{
+			if oldest == nil || ob.expires.Before(oldest.expires){
+				oldest = ob
+			}
+		}
+		p.remove(oldest)
+	}
+	ob := &orphanBlock{block, now.Add(orphanTTL)}
+	p.orphans[id] = ob
+	parent := hex.EncodeToString(block.PreBlockHash)
+	p.byParent[parent] = append(p.byParent[parent], ob)
+}
+
+func (p *orphanPool) remove(ob *orphanBlock){
+	delete(p.orphans, hex.EncodeToString(ob.block.Hash))
+	parent := hex.EncodeToString(ob.block.PreBlockHash)
+	var siblings []*orphanBlock
+	for _,sibling := range p.byParent[parent]{
+		if sibling != ob{
+			siblings = append(siblings, sibling)
+		}
+	}
+	if len(siblings) == 0{
+		delete(p.byParent, parent)
+	}else{
+		p.byParent[parent] = siblings
+	}
+}
+
+// takeChildren removes and returns the orphans waiting for parent
+func (p *orphanPool) takeChildren(parent []byte) []*Block{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var children []*Block
+	for _,ob := range p.byParent[hex.EncodeToString(parent)]{
+		delete(p.orphans, hex.EncodeToString(ob.block.Hash))
+		if time.Now().Before(ob.expires){
+			children = append(children, ob.block)
+		}
+	}
+	delete(p.byParent, hex.EncodeToString(parent))
+	return children
+}
+
+// missingAncestor follows the orphan chain from hash back to the first
+// block we do not have at all
+func (p *orphanPool) missingAncestor(hash []byte) []byte{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		ob := p.orphans[hex.EncodeToString(hash)]
+		if ob == nil{
+			return hash
+		}
+		hash = ob.block.PreBlockHash
+	}
+}
+
+// maybeOrphan tells whether block is worth keeping until its parent shows
+// up. Its target cannot be checked without the parent, but the hash must
+// still match its contents and meet the target it claims.
+func maybeOrphan(block *Block) bool{
+	if len(block.PreBlockHash) == 0{
+		return false
+	}
+	pow := NewProofOfWork(block)
+	hash := pow.hash()
+	return bytes.Equal(hash, block.Hash) && pow.meetsTarget(hash)
+}
@@ -0,0 +1,163 @@
+package blockchain_practice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A peer is a long-lived connection to another node, used in both
+// directions. Its read goroutine runs the handler of each message in turn
+// and its write goroutine sends what queue hands it, so a slow handler
+// never blocks writers and replies can go out while reading continues.
+// The fields below closeOnce are guarded by the PeerManager's lock.
+type peer struct{
+	pm 					*PeerManager
+	conn 				net.Conn
+	inbound 			bool
+	send 				chan *message
+	quit 				chan struct{}
+	closeOnce 		sync.Once
+
+	addr 				string
+	versionReceived 	bool
+	verackReceived 	bool
+	version 			int
+	bestHeight 		int
+	connected 		time.Time
+	lastSeen 			time.Time
+	pingNonce 		uint64
+	pingSent 			time.Time
+	latency 			time.Duration
+	banScore 			int
+	unconnecting 		int
+	sideHeaders 		int
+	pending 			[]*message
+}
+
+const (
+	peerSendQueue = 64
+	dialTimeout = 5 * time.Second
+	writeTimeout = 30 * time.Second
+)
+
+func newPeer(pm *PeerManager, conn net.Conn, addr string, inbound bool) *peer{
+	now := time.Now()
+	return &peer{
+		pm: pm,
+		conn: conn,
+		inbound: inbound,
+		send: make(chan *message, peerSendQueue),
+		quit: make(chan struct{}),
+		addr: addr,
+		connected: now,
+		lastSeen: now,
+	}
+}
+
+func (p *peer) start(bc *Blockchain){
+	go p.readLoop(bc)
+	go p.writeLoop()
+}
+
+func (p *peer) readLoop(bc *Blockchain){
+	defer p.close()
+	r := bufio.NewReader(p.conn)
+	for{
+		limit := uint32(maxHandshakePayload)
+		if p.pm.handshakeDone(p){
+			limit = maxMessagePayload
+		}
+		msg, err := readMessageLimit(r, limit)
+		if err != nil{
+			if err != io.EOF{
+				fmt.Printf("dropping %s: %s\n", p, err)
+			}
+			return
+		}
+		handleMessage(p, msg, bc)
+	}
+}
+
+func (p *peer) writeLoop(){
+	defer p.close()
+	for{
+		select{
+		case msg := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := writeMessage(p.conn, msg)
+			if err != nil{
+				fmt.Printf("dropping %s: %s\n", p, err)
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// queue hands a message to the write goroutine, waiting while the queue
+// is full. Until the handshake is done only version and verack go out,
+// anything else is held back and sent once it completes. It returns false
+// if the connection is closed or too much is held back.
+func (p *peer) queue(command string, payload []byte) bool{
+	msg := &message{command, payload}
+	if command != "version" && command != "verack"{
+		p.pm.mu.Lock()
+		if !p.handshakeDone(){
+			held := len(p.pending) < peerSendQueue
+			if held{
+				p.pending = append(p.pending, msg)
+			}
+			p.pm.mu.Unlock()
+			return held
+		}
+		p.pm.mu.Unlock()
+	}
+	return p.write(msg)
+}
+
+func (p *peer) write(msg *message) bool{
+	select{
+	case p.send <- msg:
+		return true
+	case <-p.quit:
+		return false
+	}
+}
+
+// handshakeDone reports whether both sides have sent version and verack.
+// The caller holds the PeerManager's lock.
+func (p *peer) handshakeDone() bool{
+	return p.versionReceived && p.verackReceived
+}
+
+func (p *peer) close(){
+	p.closeOnce.Do(func(){
+		close(p.quit)
+		p.conn.Close()
+		p.pm.remove(p)
+	})
+}
+
+func (p *peer) closed() bool{
+	select{
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *peer) String() string{
+	p.pm.mu.Lock()
+	addr := p.addr
+	p.pm.mu.Unlock()
+	if addr != ""{
+		return addr
+	}
+	return p.conn.RemoteAddr().String()
+}
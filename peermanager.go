@@ -0,0 +1,483 @@
+package blockchain_practice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Connections are opened with a version message each way, each answered
+// by a verack; only then may other messages flow. Every pingInterval a
+// ping is sent to each peer and its pong times the round trip. Peers that
+// do not finish the handshake, answer a ping or send anything in time are
+// dropped, as are peers that break the handshake. Invalid messages add to
+// the peer's ban score instead.
+const (
+	minPeerVersion = 3
+	defaultMaxInbound = 8
+	defaultMaxOutbound = 8
+	handshakeTimeout = 30 * time.Second
+	pingInterval = time.Minute
+	pingTimeout = 30 * time.Second
+	staleTimeout = 3 * pingInterval
+	maintainInterval = 10 * time.Second
+	maxDialFailures = 3
+	dialBackoff = 30 * time.Second
+)
+
+var ErrTooManyPeers = errors.New("outbound peer limit reached")
+
+type knownAddress struct{
+	failures 		int
+	lastAttempt 	time.Time
+}
+
+// PeerInfo is a copy of the state tracked for a peer
+type PeerInfo struct{
+	Addr 			string
+	Inbound 		bool
+	Handshaked 	bool
+	Version 		int
+	BestHeight 	int
+	LastSeen 		time.Time
+	Latency 		time.Duration
+	BanScore 		int
+}
+
+// PeerManager owns the node's connections and the addresses of the nodes
+// it knows. It is safe for concurrent use.
+type PeerManager struct{
+	mu 				sync.Mutex
+	bc 				*Blockchain
+	peers 			map[*peer]bool
+	byAddr 			map[string]*peer
+	known 			map[string]*knownAddress
+	dialing 		int
+	MaxInbound 		int
+	MaxOutbound 	int
+}
+
+func NewPeerManager(bc *Blockchain, seeds []string) *PeerManager{
+	pm := &PeerManager{
+		bc: bc,
+		peers: make(map[*peer]bool),
+		byAddr: make(map[string]*peer),
+		known: make(map[string]*knownAddress),
+		MaxInbound: defaultMaxInbound,
+		MaxOutbound: defaultMaxOutbound,
+	}
+	pm.AddAddresses(seeds...)
+	return pm
+}
+
+// AddAddresses adds nodes to the address book
+func (pm *PeerManager) AddAddresses(addrs ...string){
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _,addr := range addrs{
+		if addr != "" && addr != nodeAddress && pm.known[addr] == nil{
+			pm.known[addr] = &knownAddress{}
+		}
+	}
+}
+
+// KnownAddresses returns the address book
+func (pm *PeerManager) KnownAddresses() []string{
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var addrs []string
+	for addr := range pm.known{
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Peers returns the addresses of the connected nodes that have finished
+// the handshake: the one we dialed for an outbound peer, and the one an
+// inbound peer connects from
+func (pm *PeerManager) Peers() []string{
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var addrs []string
+	for addr, p := range pm.byAddr{
+		if p.handshakeDone(){
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// others returns the peers other than p that finished the handshake
+func (pm *PeerManager) others(p *peer) []*peer{
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var peers []*peer
+	for other := range pm.peers{
+		if other != p && other.handshakeDone(){
+			peers = append(peers, other)
+		}
+	}
+	return peers
+}
+
+// syncPeers returns the peers that finished the handshake
+func (pm *PeerManager) syncPeers() []*peer{
+	return pm.others(nil)
+}
+
+// sawHeight records that p has the chain up to height
+func (pm *PeerManager) sawHeight(p *peer, height int){
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if height > p.bestHeight{
+		p.bestHeight = height
+	}
+}
+
+// Info describes every open connection
+func (pm *PeerManager) Info() []PeerInfo{
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var info []PeerInfo
+	for p := range pm.peers{
+		info = append(info, PeerInfo{p.addr, p.inbound, p.handshakeDone(), p.version, p.bestHeight, p.lastSeen, p.latency, p.banScore})
+	}
+	return info
+}
+
+func (pm *PeerManager) count(inbound bool) int{
+	n := 0
+	for p := range pm.peers{
+		if p.inbound == inbound{
+			n++
+		}
+	}
+	return n
+}
+
+// Accept takes an inbound connection unless its host is banned. When the
+// inbound slots are full the inbound peer that has been quiet longest,
+// preferring ones still in the handshake, is dropped to make room.
+func (pm *PeerManager) Accept(conn net.Conn){
+	if pm.bc.IsBanned(conn.RemoteAddr().String()){
+		fmt.Printf("refusing banned %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	pm.mu.Lock()
+	var evict *peer
+	if pm.count(true) >= pm.MaxInbound{
+		for p := range pm.peers{
+			if !p.inbound{
+				continue
+			}
+			if evict == nil || evict.handshakeDone() && !p.handshakeDone() ||
+				evict.handshakeDone() == p.handshakeDone() && p.lastSeen.Before(evict.lastSeen){
+				evict = p
+			}
+		}
+	}
+	p := newPeer(pm, conn, "", true)
+	pm.peers[p] = true
+	pm.mu.Unlock()
+	if evict != nil{
+		fmt.Printf("evicting %s for a new inbound connection\n", evict)
+		evict.close()
+	}
+	p.start(pm.bc)
+}
+
+// Connect returns the connection to the node listening on addr, dialing
+// it and sending our version if there is none
+func (pm *PeerManager) Connect(addr string) (*peer, error){
+	if pm.bc.IsBanned(addr){
+		return nil, ErrBanned
+	}
+	pm.mu.Lock()
+	if p := pm.byAddr[addr]; p != nil{
+		pm.mu.Unlock()
+		return p, nil
+	}
+	// the slot is taken before dialing so concurrent calls cannot all
+	// pass the check
+	if pm.count(false)+pm.dialing >= pm.MaxOutbound{
+		pm.mu.Unlock()
+		return nil, ErrTooManyPeers
+	}
+	pm.dialing++
+	pm.mu.Unlock()
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	pm.mu.Lock()
+	pm.dialing--
+	known := pm.known[addr]
+	if known == nil && addr != nodeAddress{
+		known = &knownAddress{}
+		pm.known[addr] = known
+	}
+	if known != nil{
+		known.lastAttempt = time.Now()
+	}
+	if err != nil{
+		if known != nil{
+			known.failures++
+			if known.failures >= maxDialFailures{
+				delete(pm.known, addr)
+			}
+		}
+		pm.mu.Unlock()
+		return nil, err
+	}
+	if known != nil{
+		known.failures = 0
+	}
+	// another goroutine may have connected while we were dialing
+	if p := pm.byAddr[addr]; p != nil{
+		pm.mu.Unlock()
+		conn.Close()
+		return p, nil
+	}
+	p := newPeer(pm, conn, addr, false)
+	pm.peers[p] = true
+	pm.byAddr[addr] = p
+	pm.mu.Unlock()
+	p.start(pm.bc)
+	p.queue("version", versionPayload(pm.bc))
+	return p, nil
+}
+
+func (pm *PeerManager) remove(p *peer){
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	delete(pm.peers, p)
+	if pm.byAddr[p.addr] == p{
+		delete(pm.byAddr, p.addr)
+	}
+}
+
+// touch records that p sent something
+func (pm *PeerManager) touch(p *peer){
+	pm.mu.Lock()
+	p.lastSeen = time.Now()
+	pm.mu.Unlock()
+}
+
+// drop closes the connection to p
+func (pm *PeerManager) drop(p *peer, format string, args ...interface{}){
+	fmt.Printf("dropping %s: %s\n", p, fmt.Sprintf(format, args...))
+	p.close()
+}
+
+// inboundBanAddr returns what to ban for an inbound peer connecting from
+// remote: its host, so it can't come back from another port, unless that
+// is a loopback address shared by every local node, which is banned only
+// together with the port
+func inboundBanAddr(remote string) string{
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil{
+		return remote
+	}
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback(){
+		return remote
+	}
+	return host
+}
+
+// misbehaving adds howMuch to p's ban score for sending what failed with
+// reason. Once the score reaches banThreshold the peer is banned and
+// dropped: the address we dialed for an outbound peer, and where it
+// connects from for an inbound one, whose claimed listening address could
+// name any node.
+func (pm *PeerManager) misbehaving(p *peer, howMuch int, reason error){
+	if howMuch == 0{
+		return
+	}
+	pm.mu.Lock()
+	p.banScore += howMuch
+	score := p.banScore
+	addr := p.addr
+	pm.mu.Unlock()
+	fmt.Printf("ban score of %s now %d: %s\n", p, score, reason)
+	if score < banThreshold{
+		return
+	}
+	if p.inbound{
+		addr = inboundBanAddr(p.conn.RemoteAddr().String())
+	}
+	err := pm.bc.Ban(addr, time.Now().Add(banDuration), reason.Error())
+	if err != nil{
+		log.Panic(err)
+	}
+	pm.drop(p, "banned %s", addr)
+}
+
+// headersConnected records whether the headers p sent connected to our
+// chain and returns how many in a row did not
+func (pm *PeerManager) headersConnected(p *peer, connected bool) int{
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if connected{
+		p.unconnecting = 0
+	}else{
+		p.unconnecting++
+	}
+	return p.unconnecting
+}
+
+// sideHeaders adds n to the headers p had us store that do not lead past
+// our chain's work and returns how many it has sent
+func (pm *PeerManager) sideHeaders(p *peer, n int) int{
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	p.sideHeaders += n
+	return p.sideHeaders
+}
+
+func (pm *PeerManager) handshakeDone(p *peer) bool{
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return p.handshakeDone()
+}
+
+// gotVersion records a peer's version message and answers it, with our
+// own version first if the peer dialed us. It returns false if p was
+// dropped for it.
+func (pm *PeerManager) gotVersion(p *peer, v verzion) bool{
+	pm.mu.Lock()
+	duplicate := p.versionReceived
+	pm.mu.Unlock()
+	if duplicate{
+		pm.drop(p, "duplicate version")
+		return false
+	}
+	if v.Version < minPeerVersion{
+		pm.drop(p, "version %d is too old", v.Version)
+		return false
+	}
+	if v.AddrFrom != "" && pm.bc.IsBanned(v.AddrFrom){
+		pm.drop(p, "%s is banned", v.AddrFrom)
+		return false
+	}
+	// the replies bypass queue so nothing held back can overtake them
+	if p.inbound && !p.write(&message{"version", versionPayload(pm.bc)}){
+		return false
+	}
+	if !p.write(&message{"verack", nil}){
+		return false
+	}
+	pm.mu.Lock()
+	p.versionReceived = true
+	p.version = v.Version
+	p.bestHeight = v.BestHeight
+	// an inbound peer is reached over its own connection; the address it
+	// claims to listen on is only dialed, and so checked, like any other
+	if p.inbound{
+		p.addr = p.conn.RemoteAddr().String()
+		pm.byAddr[p.addr] = p
+	}
+	if v.AddrFrom != "" && v.AddrFrom != nodeAddress && pm.known[v.AddrFrom] == nil{
+		pm.known[v.AddrFrom] = &knownAddress{}
+	}
+	pm.mu.Unlock()
+	pm.flush(p)
+	return true
+}
+
+// gotVerack records a peer's verack, which must follow our version
+func (pm *PeerManager) gotVerack(p *peer){
+	pm.mu.Lock()
+	unexpected := p.verackReceived || p.inbound && !p.versionReceived
+	p.verackReceived = true
+	pm.mu.Unlock()
+	if unexpected{
+		pm.drop(p, "unexpected verack")
+		return
+	}
+	pm.flush(p)
+}
+
+// flush sends the messages held back during the handshake once it is done
+func (pm *PeerManager) flush(p *peer){
+	pm.mu.Lock()
+	if !p.handshakeDone(){
+		pm.mu.Unlock()
+		return
+	}
+	pending := p.pending
+	p.pending = nil
+	pm.mu.Unlock()
+	for _,msg := range pending{
+		if !p.write(msg){
+			return
+		}
+	}
+}
+
+// gotPong times the round trip of the ping nonce answers
+func (pm *PeerManager) gotPong(p *peer, nonce uint64){
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if nonce != 0 && nonce == p.pingNonce{
+		p.latency = time.Since(p.pingSent)
+		p.pingNonce = 0
+	}
+}
+
+// Run does the periodic upkeep: dropping peers that stalled, pinging the
+// rest and dialing known nodes while there are free outbound slots
+func (pm *PeerManager) Run(){
+	for{
+		pm.maintain(time.Now())
+		time.Sleep(maintainInterval)
+	}
+}
+
+func (pm *PeerManager) maintain(now time.Time){
+	var drop, pinged []*peer
+	var reasons []string
+	var nonces []uint64
+	pm.mu.Lock()
+	for p := range pm.peers{
+		switch {
+		case !p.handshakeDone() && now.Sub(p.connected) > handshakeTimeout:
+			drop, reasons = append(drop, p), append(reasons, "handshake timed out")
+		case now.Sub(p.lastSeen) > staleTimeout:
+			drop, reasons = append(drop, p), append(reasons, "nothing received")
+		case p.pingNonce != 0 && now.Sub(p.pingSent) > pingTimeout:
+			drop, reasons = append(drop, p), append(reasons, "ping timed out")
+		case p.handshakeDone() && p.pingNonce == 0 && now.Sub(p.pingSent) > pingInterval:
+			p.pingNonce = rand.Uint64() | 1
+			p.pingSent = now
+			pinged, nonces = append(pinged, p), append(nonces, p.pingNonce)
+		}
+	}
+	var dial []string
+	free := pm.MaxOutbound - pm.count(false) - pm.dialing
+	for addr, known := range pm.known{
+		if free <= len(dial){
+			break
+		}
+		if pm.byAddr[addr] == nil && now.Sub(known.lastAttempt) > time.Duration(known.failures)*dialBackoff{
+			dial = append(dial, addr)
+		}
+	}
+	pm.mu.Unlock()
+	for i, p := range drop{
+		pm.drop(p, reasons[i])
+	}
+	for i, p := range pinged{
+		p.queue("ping", gobEncode(ping{nonces[i]}))
+	}
+	for _,addr := range dial{
+		_, err := pm.Connect(addr)
+		if err != nil && err != ErrBanned{
+			fmt.Printf("%s unavailable: %s\n", addr, err)
+		}
+	}
+}
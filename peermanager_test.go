@@ -0,0 +1,49 @@
+package blockchain_practice
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestInboundBanAddr(t *testing.T){
+	tests := map[string]string{
+		"203.0.113.5:4001": "203.0.113.5",
+		"[2001:db8::1]:4001": "2001:db8::1",
+		"127.0.0.1:4001": "127.0.0.1:4001",
+		"[::1]:4001": "[::1]:4001",
+		"localhost:4001": "localhost:4001",
+		"pipe": "pipe",
+	}
+	for remote, want := range tests{
+		if got := inboundBanAddr(remote); got != want{
+			t.Errorf("%s: got %s, want %s", remote, got, want)
+		}
+	}
+}
+
+func TestInboundPeerKeyedByRemoteAddr(t *testing.T){
+	bc, _ := newTestChain(t)
+	pm := NewPeerManager(bc, nil)
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	p := newPeer(pm, conn, "", true)
+	pm.peers[p] = true
+	claimed := "203.0.113.5:4001"
+	if !pm.gotVersion(p, verzion{nodeVersion, 0, nil, claimed}){
+		t.Fatal("dropped")
+	}
+	pm.gotVerack(p)
+	// the claimed address is not taken as the peer's, only remembered
+	if peers := pm.Peers(); !reflect.DeepEqual(peers, []string{conn.RemoteAddr().String()}){
+		t.Fatal("peers", peers)
+	}
+	if known := pm.KnownAddresses(); !reflect.DeepEqual(known, []string{claimed}){
+		t.Fatal("known", known)
+	}
+	pm.remove(p)
+	if len(pm.byAddr) != 0{
+		t.Fatal("removed peer still registered")
+	}
+}
@@ -1,42 +1,41 @@
 package blockchain_practice
 
 import(
-	"bytes"
 	"math/big"
 	"math"
 	"fmt"
 	"crypto/sha256"
-	"encoding/binary"
-	"log"
 )
 
 const targetbits = 16
 var maxNonce = math.MaxInt64
 
+// difficulty is retargeted every retargetInterval blocks so that blocks
+// arrive roughly every targetBlockTime seconds
+const (
+	retargetInterval = 10
+	targetBlockTime = 10
+	targetTimespan = retargetInterval * targetBlockTime
+)
+
+// powLimit is the easiest target a block may use
+var powLimit = new(big.Int).Lsh(big.NewInt(1), uint(256-targetbits))
+
 type ProofOfWork struct{
 	block 	*Block
 	target 	*big.Int
 }
 
 func NewProofOfWork(block *Block) *ProofOfWork{
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetbits))
+	target := CompactToBig(block.Bits)
 	pow := &ProofOfWork{block, target}
 	return pow
 }
 
 func (pow *ProofOfWork) prepareData(nonce int) []byte{
-	data := bytes.Join{
-		[][]byte{
-			pow.block.PreBlockHash,
-			pow.block.HashTransactions(),
-			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetbits)),
-			IntToHex(int64(nonce)),
-		},
-		[]byte{},
-	}
-	return data
+	header := pow.block.BlockHeader
+	header.Nonce = nonce
+	return header.Serialize()
 }
 
 func (pow *ProofOfWork) Run() (int, []byte){
@@ -61,11 +60,98 @@ func (pow *ProofOfWork) Run() (int, []byte){
 	return nonce, hash[:]
 }
 
-func (pow *ProofOfWork) Validate() bool{
+// Validate checks the block hash against its target and that the target
+// is the one the chain rules require at the block's height
+func (pow *ProofOfWork) Validate(bc *Blockchain) bool{
+	if pow.block.Bits != bc.CalcNextBits(pow.block.PreBlockHash){
+		return false
+	}
+	return pow.meetsTarget(pow.hash())
+}
+
+// hash recomputes the block hash for the block's own nonce
+func (pow *ProofOfWork) hash() []byte{
+	hash := sha256.Sum256(pow.prepareData(pow.block.Nonce))
+	return hash[:]
+}
+
+func (pow *ProofOfWork) meetsTarget(hash []byte) bool{
 	var hashInt big.Int
-	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
-	isValid := hashInt.Cmp(pow.target) == -1
-	return isValid
-}
\ No newline at end of file
+	if pow.target.Sign() <= 0 || pow.target.Cmp(powLimit) > 0{
+		return false
+	}
+	hashInt.SetBytes(hash)
+	return hashInt.Cmp(pow.target) == -1
+}
+
+// retarget scales the target in bits by how long the previous window
+// actually took, clamped to a factor of 4 either way
+func retarget(bits uint32, actualTimespan int64) uint32{
+	if actualTimespan < targetTimespan/4{
+		actualTimespan = targetTimespan/4
+	}
+	if actualTimespan > targetTimespan*4{
+		actualTimespan = targetTimespan*4
+	}
+	newTarget := CompactToBig(bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if newTarget.Cmp(powLimit) > 0{
+		newTarget.Set(powLimit)
+	}
+	return BigToCompact(newTarget)
+}
+
+// CalcWork returns the expected number of hashes needed to find a block
+// with the given target bits, 2^256 / target
+func CalcWork(bits uint32) *big.Int{
+	target := CompactToBig(bits)
+	if target.Sign() <= 0{
+		return big.NewInt(0)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target)
+}
+
+// CompactToBig expands the compact representation used in Block.Bits:
+// the high byte is the length of the target in bytes and the low three
+// bytes are its most significant digits
+func CompactToBig(compact uint32) *big.Int{
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+	target := big.NewInt(int64(mantissa))
+	if exponent <= 3{
+		target.Rsh(target, 8*(3-exponent))
+	}else{
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if compact&0x00800000 != 0{
+		target.Neg(target)
+	}
+	return target
+}
+
+func BigToCompact(n *big.Int) uint32{
+	if n.Sign() == 0{
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3{
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	}else{
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+	// the sign bit must stay clear, so shift into the exponent instead
+	if mantissa&0x00800000 != 0{
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0{
+		compact |= 0x00800000
+	}
+	return compact
+}
@@ -0,0 +1,94 @@
+package blockchain_practice
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestCompactEncoding(t *testing.T){
+	tests := []struct{
+		compact 	uint32
+		value 	string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x03123456, "123456"},
+		{0x04123456, "12345600"},
+		{0x02008000, "80"},
+		{0x05009234, "92340000"},
+		{0x04923456, "-12345600"},
+	}
+	for _,test := range tests{
+		want, _ := new(big.Int).SetString(test.value, 16)
+		if got := CompactToBig(test.compact); got.Cmp(want) != 0{
+			t.Errorf("%08x: got %x, want %x", test.compact, got, want)
+		}
+		if got := BigToCompact(want); got != test.compact{
+			t.Errorf("%x: got %08x, want %08x", want, got, test.compact)
+		}
+	}
+	// precision below the three mantissa bytes is dropped
+	if got := CompactToBig(0x01123456); got.Cmp(big.NewInt(0x12)) != 0{
+		t.Errorf("got %x", got)
+	}
+	if got := CompactToBig(BigToCompact(powLimit)); got.Cmp(powLimit) != 0{
+		t.Errorf("proof of work limit changed to %x", got)
+	}
+}
+
+func TestRetarget(t *testing.T){
+	hard := new(big.Int).Rsh(powLimit, 8)
+	bits := BigToCompact(hard)
+	scaled := func(num, den int64) *big.Int{
+		target := new(big.Int).Mul(hard, big.NewInt(num))
+		return target.Div(target, big.NewInt(den))
+	}
+	tests := []struct{
+		name 		string
+		timespan 	int64
+		target 	*big.Int
+	}{
+		{"on schedule", targetTimespan, hard},
+		{"twice as fast", targetTimespan/2, scaled(1, 2)},
+		{"twice as slow", targetTimespan*2, scaled(2, 1)},
+		{"far too fast", 1, scaled(1, 4)},
+		{"far too slow", targetTimespan*100, scaled(4, 1)},
+	}
+	for _,test := range tests{
+		if got := CompactToBig(retarget(bits, test.timespan)); got.Cmp(CompactToBig(BigToCompact(test.target))) != 0{
+			t.Errorf("%s: got %x, want %x", test.name, got, test.target)
+		}
+	}
+	if got := retarget(BigToCompact(powLimit), targetTimespan*2); got != BigToCompact(powLimit){
+		t.Errorf("target above the limit: %08x", got)
+	}
+	if CalcWork(BigToCompact(hard)).Cmp(new(big.Int).Mul(CalcWork(BigToCompact(powLimit)), big.NewInt(256))) != 0{
+		t.Error("work does not scale with the target")
+	}
+}
+
+func TestDifficultyAdjustsOnChain(t *testing.T){
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	tip := tipBlock(t, bc)
+	genesisBits := tip.Bits
+	// a block may not pick its own target
+	own := NewBlockAt([]*Transaction{NewCoinbaseTX(address, "", 1, 0)}, tip.Hash, 1, BigToCompact(new(big.Int).Rsh(powLimit, 1)), tip.Timestamp+targetBlockTime)
+	if _, err := bc.AddBlock(own); !errors.Is(err, ErrBadProofOfWork){
+		t.Fatal("block with its own bits accepted", err)
+	}
+	for i := 1; i < retargetInterval; i++{
+		tip = mineAt(bc, tip, tip.Timestamp+1, address)
+		if tip.Bits != genesisBits{
+			t.Fatalf("retargeted inside the window at height %d", tip.Height)
+		}
+		if _, err := bc.AddBlock(tip); err != nil{
+			t.Fatal(err)
+		}
+	}
+	// the window took a second a block, so the next target is a quarter
+	want := BigToCompact(new(big.Int).Div(CompactToBig(genesisBits), big.NewInt(4)))
+	if got := bc.CalcNextBits(tip.Hash); got != want{
+		t.Fatalf("bits after a fast window %08x, want %08x", got, want)
+	}
+}
@@ -0,0 +1,111 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// connectBlock checks block's inputs against the UTXO set and applies it.
+// The UTXO set must be at block's parent.
+func connectBlock(tx *bolt.Tx, block *Block) error{
+	err := checkBlockInputs(tx, block)
+	if err != nil{
+		return err
+	}
+	err = updateUTXO(tx, block)
+	if err != nil{
+		return err
+	}
+	err = indexBlockTxs(tx, block)
+	if err != nil{
+		return err
+	}
+	return setMainChain(tx, block.Height, block.Hash)
+}
+
+// disconnectBlock takes the tip block back out of the UTXO set and the
+// transaction and main chain indexes
+func disconnectBlock(tx *bolt.Tx, block *Block) error{
+	err := disconnectUTXO(tx, block)
+	if err != nil{
+		return err
+	}
+	err = unindexBlockTxs(tx, block)
+	if err != nil{
+		return err
+	}
+	return unsetMainChain(tx, block.Height)
+}
+
+// reorganize moves the UTXO set from oldTip to newTip: blocks are
+// disconnected back to the fork point, then the new branch is connected
+// from there. Any error leaves the caller's bolt transaction to roll back.
+func reorganize(tx *bolt.Tx, oldTip []byte, newTip *Block) ([]*Transaction, error){
+	b := tx.Bucket([]byte(blocksBucket))
+	var detachHashes, attachHashes [][]byte
+	oldHash, newHash := oldTip, newTip.Hash
+	oldHeader, newHeader := getHeader(tx, oldHash), getHeader(tx, newHash)
+	for newHeader.Height > oldHeader.Height{
+		attachHashes = append(attachHashes, newHash)
+		newHash = newHeader.PreBlockHash
+		newHeader = getHeader(tx, newHash)
+	}
+	for oldHeader.Height > newHeader.Height{
+		detachHashes = append(detachHashes, oldHash)
+		oldHash = oldHeader.PreBlockHash
+		oldHeader = getHeader(tx, oldHash)
+	}
+	for !bytes.Equal(oldHash, newHash){
+		detachHashes = append(detachHashes, oldHash)
+		attachHashes = append(attachHashes, newHash)
+		oldHash, newHash = oldHeader.PreBlockHash, newHeader.PreBlockHash
+		oldHeader, newHeader = getHeader(tx, oldHash), getHeader(tx, newHash)
+	}
+	var detach, attach []*Block
+	for _,hash := range detachHashes{
+		block, err := DeserializeBlock(b.Get(hash))
+		if err != nil{
+			return nil, err
+		}
+		detach = append(detach, block)
+	}
+	for _,hash := range attachHashes{
+		if isInvalid(tx, hash){
+			return nil, &BlockError{newTip.Hash, ErrInvalidated, fmt.Sprintf("ancestor %x", hash)}
+		}
+		block, err := DeserializeBlock(b.Get(hash))
+		if err != nil{
+			return nil, err
+		}
+		attach = append(attach, block)
+	}
+
+	for _,block := range detach{
+		err := disconnectBlock(tx, block)
+		if err != nil{
+			return nil, err
+		}
+	}
+	confirmed := make(map[string]bool)
+	for i:=len(attach)-1;i>=0;i--{
+		err := connectBlock(tx, attach[i])
+		if err != nil{
+			return nil, err
+		}
+		for _,t := range attach[i].Transactions{
+			confirmed[hex.EncodeToString(t.HashID)] = true
+		}
+	}
+
+	var orphaned []*Transaction
+	for _,block := range detach{
+		for _,t := range block.Transactions{
+			if !t.IsCoinbase() && !confirmed[hex.EncodeToString(t.HashID)]{
+				orphaned = append(orphaned, t)
+			}
+		}
+	}
+	return orphaned, nil
+}
@@ -0,0 +1,78 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"testing"
+)
+
+// parentOf returns the stored parent of block
+func parentOf(t *testing.T, bc *Blockchain, block *Block) *Block{
+	parent, err := bc.GetBlock(block.PreBlockHash)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return &parent
+}
+
+// checkUTXOSet fails unless the UTXO set is the one rebuilt from the blocks
+func checkUTXOSet(t *testing.T, bc *Blockchain){
+	t.Helper()
+	maintained := UTXOSet{bc}.Hash().Hash
+	UTXOSet{bc}.Reindex()
+	if !bytes.Equal(maintained, UTXOSet{bc}.Hash().Hash){
+		t.Fatal("UTXO set differs from a rebuilt one")
+	}
+}
+
+func TestReorganize(t *testing.T){
+	bc, wallet, spend := spendingChain(t)
+	address := string(wallet.GetAddress())
+	a3 := tipBlock(t, bc)
+	a1 := parentOf(t, bc, parentOf(t, bc, a3))
+	// a branch with as much work as ours is stored but not switched to
+	b := a1
+	for i := 0; i < 2; i++{
+		b = mineOn(bc, b, address)
+		orphaned, err := bc.AddBlock(b)
+		if err != nil || len(orphaned) != 0{
+			t.Fatal(orphaned, err)
+		}
+	}
+	if !bytes.Equal(bc.tail, a3.Hash){
+		t.Fatal("switched to a branch with equal work")
+	}
+	b = mineOn(bc, b, address)
+	orphaned, err := bc.AddBlock(b)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.tail, b.Hash) || bc.GetBestHeight() != 4{
+		t.Fatal("not reorganized to the heavier branch")
+	}
+	if len(orphaned) != 1 || !bytes.Equal(orphaned[0].HashID, spend.HashID){
+		t.Fatal("orphaned transactions", orphaned)
+	}
+	checkUTXOSet(t, bc)
+	// a heavier branch with an invalid block leaves everything as it was
+	before := UTXOSet{bc}.Hash().Hash
+	a4 := mineOn(bc, a3, address)
+	if _, err := bc.AddBlock(a4); err != nil{
+		t.Fatal(err)
+	}
+	bad := mineOn(bc, a4, address, spend)
+	if _, err := bc.AddBlock(bad); err == nil{
+		t.Fatal("branch spending an output twice accepted")
+	}
+	if !bytes.Equal(bc.tail, b.Hash) || !bytes.Equal(UTXOSet{bc}.Hash().Hash, before){
+		t.Fatal("failed reorganization changed the chain")
+	}
+	// while the valid part of it can still win
+	a5 := mineOn(bc, a4, address)
+	if _, err := bc.AddBlock(a5); err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.tail, a5.Hash){
+		t.Fatal("not reorganized back")
+	}
+	checkUTXOSet(t, bc)
+}
@@ -0,0 +1,690 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Outputs are locked by a LockScript and spent by an UnlockScript. To
+// spend, the unlock script is run first and the lock script is then run on
+// the stack it leaves; the spend is valid when the top item is true. The
+// opcodes are a small subset of Bitcoin's, with the same byte values.
+const (
+	OP_0 = 0x00
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1NEGATE = 0x4f
+	OP_1 = 0x51
+	OP_16 = 0x60
+	OP_IF = 0x63
+	OP_NOTIF = 0x64
+	OP_ELSE = 0x67
+	OP_ENDIF = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+	OP_DROP = 0x75
+	OP_DUP = 0x76
+	OP_SIZE = 0x82
+	OP_EQUAL = 0x87
+	OP_EQUALVERIFY = 0x88
+	OP_SHA256 = 0xa8
+	OP_HASH160 = 0xa9
+	OP_CHECKSIG = 0xac
+	OP_CHECKSIGVERIFY = 0xad
+	OP_CHECKMULTISIG = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+var opcodeNames = map[byte]string{
+	OP_0: "OP_0", OP_1NEGATE: "OP_1NEGATE",
+	OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF",
+	OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN",
+	OP_DROP: "OP_DROP", OP_DUP: "OP_DUP", OP_SIZE: "OP_SIZE",
+	OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY",
+	OP_SHA256: "OP_SHA256", OP_HASH160: "OP_HASH160",
+	OP_CHECKSIG: "OP_CHECKSIG", OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG: "OP_CHECKMULTISIG", OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY", OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+const (
+	maxScriptSize = 10000
+	maxStackSize = 1000
+	maxScriptOps = 201
+	maxMultisigKeys = 20
+	// lock times below this are block heights, above it unix timestamps
+	lockTimeThreshold = 500000000
+)
+
+var (
+	ErrScriptFailed = errors.New("script failed")
+	ErrMalformedScript = errors.New("malformed script")
+)
+
+type scriptOp struct{
+	opcode 	byte
+	data 		[]byte
+}
+
+func parseScript(script []byte) ([]scriptOp, error){
+	if len(script) > maxScriptSize{
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformedScript, len(script))
+	}
+	var ops []scriptOp
+	for i:=0;i<len(script);{
+		opcode := script[i]
+		i++
+		var n int
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			n = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script){
+				return nil, fmt.Errorf("%w: truncated push", ErrMalformedScript)
+			}
+			n = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script){
+				return nil, fmt.Errorf("%w: truncated push", ErrMalformedScript)
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+		if i+n > len(script){
+			return nil, fmt.Errorf("%w: truncated push", ErrMalformedScript)
+		}
+		ops = append(ops, scriptOp{opcode, script[i:i+n]})
+		i += n
+	}
+	return ops, nil
+}
+
+func isPushOnly(script []byte) bool{
+	ops, err := parseScript(script)
+	if err != nil{
+		return false
+	}
+	for _,op := range ops{
+		if op.opcode > OP_16{
+			return false
+		}
+	}
+	return true
+}
+
+// pushData appends the shortest push of data to script
+func pushData(script []byte, data []byte) []byte{
+	switch {
+	case len(data) == 0:
+		return append(script, OP_0)
+	case len(data) < OP_PUSHDATA1:
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		script = append(script, OP_PUSHDATA2, byte(len(data)), byte(len(data)>>8))
+	}
+	return append(script, data...)
+}
+
+func pushInt(script []byte, n int64) []byte{
+	if n == 0{
+		return append(script, OP_0)
+	}
+	if n >= 1 && n <= 16{
+		return append(script, byte(OP_1+n-1))
+	}
+	return pushData(script, scriptNum(n))
+}
+
+// scriptNum encodes n as a little-endian sign-magnitude number
+func scriptNum(n int64) []byte{
+	if n == 0{
+		return nil
+	}
+	negative := n < 0
+	abs := uint64(n)
+	if negative{
+		abs = uint64(-n)
+	}
+	var result []byte
+	for abs > 0{
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0{
+		extra := byte(0x00)
+		if negative{
+			extra = 0x80
+		}
+		result = append(result, extra)
+	}else if negative{
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+// parseScriptNum decodes a number of at most maxLen bytes
+func parseScriptNum(data []byte, maxLen int) (int64, error){
+	if len(data) > maxLen{
+		return 0, fmt.Errorf("%w: number of %d bytes", ErrScriptFailed, len(data))
+	}
+	if len(data) == 0{
+		return 0, nil
+	}
+	var n int64
+	for i, b := range data{
+		n |= int64(b) << uint(8*i)
+	}
+	if data[len(data)-1]&0x80 != 0{
+		n &^= int64(0x80) << uint(8*(len(data)-1))
+		return -n, nil
+	}
+	return n, nil
+}
+
+func castToBool(data []byte) bool{
+	for i, b := range data{
+		if b != 0{
+			// negative zero is false
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+// NewP2PKHScript locks an output to the key hashing to pubkeyhash:
+// OP_DUP OP_HASH160 <pubkeyhash> OP_EQUALVERIFY OP_CHECKSIG
+func NewP2PKHScript(pubkeyhash []byte) []byte{
+	script := []byte{OP_DUP, OP_HASH160}
+	script = pushData(script, pubkeyhash)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// NewMultisigScript needs m of the given public keys to sign:
+// <m> <pubkey>... <n> OP_CHECKMULTISIG
+func NewMultisigScript(m int, pubkeys [][]byte) ([]byte, error){
+	if m < 1 || m > len(pubkeys) || len(pubkeys) > maxMultisigKeys{
+		return nil, fmt.Errorf("bad multisig %d of %d", m, len(pubkeys))
+	}
+	script := pushInt(nil, int64(m))
+	for _,pubkey := range pubkeys{
+		if _, err := parsePubKey(pubkey); err != nil{
+			return nil, err
+		}
+		script = pushData(script, pubkey)
+	}
+	script = pushInt(script, int64(len(pubkeys)))
+	return append(script, OP_CHECKMULTISIG), nil
+}
+
+// NewHashLockScript can be spent by revealing the preimage of hash
+// together with a signature of the key hashing to pubkeyhash:
+// OP_SHA256 <hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <pubkeyhash> OP_EQUALVERIFY OP_CHECKSIG
+func NewHashLockScript(hash, pubkeyhash []byte) []byte{
+	script := []byte{OP_SHA256}
+	script = pushData(script, hash)
+	script = append(script, OP_EQUALVERIFY)
+	return append(script, NewP2PKHScript(pubkeyhash)...)
+}
+
+// NewTimeLockScript can be spent by pubkeyhash's key in a transaction
+// whose LockTime has reached locktime, a block height or a unix time:
+// <locktime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <pubkeyhash> OP_EQUALVERIFY OP_CHECKSIG
+func NewTimeLockScript(locktime int64, pubkeyhash []byte) []byte{
+	script := pushInt(nil, locktime)
+	script = append(script, OP_CHECKLOCKTIMEVERIFY, OP_DROP)
+	return append(script, NewP2PKHScript(pubkeyhash)...)
+}
+
+// NewRelativeLockScript can be spent by pubkeyhash's key from an input
+// whose Sequence holds at least the relative lock in sequence, see
+// RelativeLockBlocks and RelativeLockSeconds:
+// <sequence> OP_CHECKSEQUENCEVERIFY OP_DROP OP_DUP OP_HASH160 <pubkeyhash> OP_EQUALVERIFY OP_CHECKSIG
+func NewRelativeLockScript(sequence uint32, pubkeyhash []byte) []byte{
+	script := pushInt(nil, int64(sequence))
+	script = append(script, OP_CHECKSEQUENCEVERIFY, OP_DROP)
+	return append(script, NewP2PKHScript(pubkeyhash)...)
+}
+
+// NewP2SHScript pays to the hash of a redeem script. The spender reveals
+// the redeem script as the last push of the unlock script, and it is then
+// run on the rest of the stack: OP_HASH160 <scripthash> OP_EQUAL
+func NewP2SHScript(scripthash []byte) []byte{
+	script := pushData([]byte{OP_HASH160}, scripthash)
+	return append(script, OP_EQUAL)
+}
+
+func isP2SH(script []byte) bool{
+	return len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL
+}
+
+// parseMultisigScript returns m and the keys of a script made by
+// NewMultisigScript
+func parseMultisigScript(script []byte) (int, [][]byte, error){
+	ops, err := parseScript(script)
+	if err != nil{
+		return 0, nil, err
+	}
+	if len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG{
+		return 0, nil, fmt.Errorf("%w: not a multisig script", ErrMalformedScript)
+	}
+	small := func(op scriptOp) int{
+		if op.opcode >= OP_1 && op.opcode <= OP_16{
+			return int(op.opcode-OP_1+1)
+		}
+		return -1
+	}
+	m, n := small(ops[0]), small(ops[len(ops)-2])
+	if m < 1 || n != len(ops)-3 || m > n{
+		return 0, nil, fmt.Errorf("%w: not a multisig script", ErrMalformedScript)
+	}
+	var pubkeys [][]byte
+	for _,op := range ops[1:len(ops)-2]{
+		pubkeys = append(pubkeys, op.data)
+	}
+	return m, pubkeys, nil
+}
+
+// extractPubKeyHash returns the key hash of a pay-to-pubkey-hash script
+func extractPubKeyHash(script []byte) []byte{
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 &&
+		script[2] == 20 && script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG{
+		return script[3:23]
+	}
+	return nil
+}
+
+// DisasmScript renders script as opcodes and hex pushes
+func DisasmScript(script []byte) string{
+	ops, err := parseScript(script)
+	if err != nil{
+		return fmt.Sprintf("[error: %s] %x", err, script)
+	}
+	var parts []string
+	for _,op := range ops{
+		switch {
+		case op.opcode > OP_0 && op.opcode <= OP_PUSHDATA2:
+			parts = append(parts, fmt.Sprintf("%x", op.data))
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			parts = append(parts, fmt.Sprintf("OP_%d", op.opcode-OP_1+1))
+		case opcodeNames[op.opcode] != "":
+			parts = append(parts, opcodeNames[op.opcode])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN_%02x", op.opcode))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// scriptEngine runs the scripts of one input. Signatures commit to
+// scriptCode: the lock script, or the redeem script of a
+// pay-to-script-hash output.
+type scriptEngine struct{
+	tx 			*Transaction
+	idx 			int
+	prevOut 	TXOutput
+	scriptCode	[]byte
+	stack 		[][]byte
+}
+
+// VerifyScript checks that input idx of tx may spend prevOut
+func VerifyScript(tx *Transaction, idx int, prevOut TXOutput) error{
+	unlock := tx.Vin[idx].UnlockScript
+	if !isPushOnly(unlock){
+		return fmt.Errorf("%w: unlock script must only push data", ErrScriptFailed)
+	}
+	e := &scriptEngine{tx: tx, idx: idx, prevOut: prevOut}
+	e.scriptCode = prevOut.LockScript
+	if err := e.execute(unlock); err != nil{
+		return err
+	}
+	unlocked := append([][]byte{}, e.stack...)
+	if err := e.execute(prevOut.LockScript); err != nil{
+		return err
+	}
+	if err := e.checkTop(); err != nil{
+		return err
+	}
+	if !isP2SH(prevOut.LockScript){
+		return nil
+	}
+	// the lock script checked the redeem script's hash, now run it
+	redeem := unlocked[len(unlocked)-1]
+	e.stack = unlocked[:len(unlocked)-1]
+	e.scriptCode = redeem
+	if err := e.execute(redeem); err != nil{
+		return err
+	}
+	return e.checkTop()
+}
+
+func (e *scriptEngine) checkTop() error{
+	if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]){
+		return fmt.Errorf("%w: false on top of stack", ErrScriptFailed)
+	}
+	return nil
+}
+
+func (e *scriptEngine) push(data []byte){
+	e.stack = append(e.stack, data)
+}
+
+func (e *scriptEngine) pop() ([]byte, error){
+	if len(e.stack) == 0{
+		return nil, fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+func (e *scriptEngine) popInt(maxLen int) (int64, error){
+	data, err := e.pop()
+	if err != nil{
+		return 0, err
+	}
+	return parseScriptNum(data, maxLen)
+}
+
+func (e *scriptEngine) execute(script []byte) error{
+	ops, err := parseScript(script)
+	if err != nil{
+		return err
+	}
+	var cond []bool
+	opCount := 0
+	for _,op := range ops{
+		executing := true
+		for _,c := range cond{
+			executing = executing && c
+		}
+		if op.opcode > OP_16{
+			opCount++
+			if opCount > maxScriptOps{
+				return fmt.Errorf("%w: too many operations", ErrScriptFailed)
+			}
+		}
+		if !executing && (op.opcode < OP_IF || op.opcode > OP_ENDIF){
+			continue
+		}
+		err := e.step(op, executing, &cond)
+		if err != nil{
+			return err
+		}
+		if len(e.stack) > maxStackSize{
+			return fmt.Errorf("%w: stack overflow", ErrScriptFailed)
+		}
+	}
+	if len(cond) != 0{
+		return fmt.Errorf("%w: unbalanced conditional", ErrScriptFailed)
+	}
+	return nil
+}
+
+func (e *scriptEngine) step(op scriptOp, executing bool, cond *[]bool) error{
+	switch {
+	case op.opcode <= OP_PUSHDATA2:
+		e.push(op.data)
+		return nil
+	case op.opcode == OP_1NEGATE:
+		e.push(scriptNum(-1))
+		return nil
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		e.push(scriptNum(int64(op.opcode-OP_1+1)))
+		return nil
+	}
+
+	switch op.opcode{
+	case OP_IF, OP_NOTIF:
+		value := false
+		if executing{
+			top, err := e.pop()
+			if err != nil{
+				return err
+			}
+			value = castToBool(top) == (op.opcode == OP_IF)
+		}
+		*cond = append(*cond, value)
+	case OP_ELSE:
+		if len(*cond) == 0{
+			return fmt.Errorf("%w: OP_ELSE without OP_IF", ErrScriptFailed)
+		}
+		(*cond)[len(*cond)-1] = !(*cond)[len(*cond)-1]
+	case OP_ENDIF:
+		if len(*cond) == 0{
+			return fmt.Errorf("%w: OP_ENDIF without OP_IF", ErrScriptFailed)
+		}
+		*cond = (*cond)[:len(*cond)-1]
+	case OP_VERIFY:
+		return e.verify("OP_VERIFY")
+	case OP_RETURN:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		if len(e.stack) == 0{
+			return fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+		}
+		e.push(e.stack[len(e.stack)-1])
+	case OP_SIZE:
+		if len(e.stack) == 0{
+			return fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+		}
+		e.push(scriptNum(int64(len(e.stack[len(e.stack)-1]))))
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil{
+			return err
+		}
+		b, err := e.pop()
+		if err != nil{
+			return err
+		}
+		e.pushBool(bytes.Equal(a, b))
+		if op.opcode == OP_EQUALVERIFY{
+			return e.verify("OP_EQUALVERIFY")
+		}
+	case OP_SHA256:
+		data, err := e.pop()
+		if err != nil{
+			return err
+		}
+		hash := sha256.Sum256(data)
+		e.push(hash[:])
+	case OP_HASH160:
+		data, err := e.pop()
+		if err != nil{
+			return err
+		}
+		e.push(HashPubKey(data))
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubkey, err := e.pop()
+		if err != nil{
+			return err
+		}
+		sig, err := e.pop()
+		if err != nil{
+			return err
+		}
+		ok, err := e.checkSig(sig, pubkey)
+		if err != nil{
+			return err
+		}
+		e.pushBool(ok)
+		if op.opcode == OP_CHECKSIGVERIFY{
+			return e.verify("OP_CHECKSIGVERIFY")
+		}
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := e.checkMultisig()
+		if err != nil{
+			return err
+		}
+		e.pushBool(ok)
+		if op.opcode == OP_CHECKMULTISIGVERIFY{
+			return e.verify("OP_CHECKMULTISIGVERIFY")
+		}
+	case OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLockTime()
+	case OP_CHECKSEQUENCEVERIFY:
+		return e.checkSequence()
+	default:
+		return fmt.Errorf("%w: unknown opcode %02x", ErrScriptFailed, op.opcode)
+	}
+	return nil
+}
+
+func (e *scriptEngine) pushBool(value bool){
+	if value{
+		e.push([]byte{1})
+	}else{
+		e.push(nil)
+	}
+}
+
+func (e *scriptEngine) verify(name string) error{
+	top, err := e.pop()
+	if err != nil{
+		return err
+	}
+	if !castToBool(top){
+		return fmt.Errorf("%w: %s", ErrScriptFailed, name)
+	}
+	return nil
+}
+
+// checkSig reports whether sig, a DER signature followed by its hash type,
+// signs this input for pubkey. An empty signature is simply false, a
+// malformed one fails the script.
+func (e *scriptEngine) checkSig(sig, pubkey []byte) (bool, error){
+	if len(sig) == 0{
+		return false, nil
+	}
+	hashType := SigHashType(sig[len(sig)-1])
+	r, s, err := parseSignature(sig[:len(sig)-1])
+	if err != nil{
+		return false, fmt.Errorf("%w: %s", ErrScriptFailed, err)
+	}
+	key, err := parsePubKey(pubkey)
+	if err != nil{
+		return false, fmt.Errorf("%w: %s", ErrScriptFailed, err)
+	}
+	hash, err := e.tx.SignatureHash(e.idx, TXOutput{e.prevOut.Value, e.scriptCode}, hashType)
+	if err != nil{
+		return false, fmt.Errorf("%w: %s", ErrScriptFailed, err)
+	}
+	return ecdsa.Verify(key, hash, r, s), nil
+}
+
+// checkMultisig pops <sig>... <m> <pubkey>... <n>. Signatures have to be in
+// the same order as the keys they belong to.
+func (e *scriptEngine) checkMultisig() (bool, error){
+	n, err := e.popInt(4)
+	if err != nil{
+		return false, err
+	}
+	if n < 0 || n > maxMultisigKeys{
+		return false, fmt.Errorf("%w: %d keys", ErrScriptFailed, n)
+	}
+	pubkeys := make([][]byte, n)
+	for i:=int(n)-1;i>=0;i--{
+		if pubkeys[i], err = e.pop(); err != nil{
+			return false, err
+		}
+	}
+	m, err := e.popInt(4)
+	if err != nil{
+		return false, err
+	}
+	if m < 0 || m > n{
+		return false, fmt.Errorf("%w: %d of %d signatures", ErrScriptFailed, m, n)
+	}
+	sigs := make([][]byte, m)
+	for i:=int(m)-1;i>=0;i--{
+		if sigs[i], err = e.pop(); err != nil{
+			return false, err
+		}
+	}
+	k := 0
+	for _,sig := range sigs{
+		matched := false
+		for k < len(pubkeys) && !matched{
+			matched, err = e.checkSig(sig, pubkeys[k])
+			if err != nil{
+				return false, err
+			}
+			k++
+		}
+		if !matched{
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkLockTime fails unless the transaction's LockTime has reached the
+// lock time on top of the stack, which is left in place. Consensus makes
+// sure the LockTime itself has passed, as long as the input is not final.
+func (e *scriptEngine) checkLockTime() error{
+	locktime, err := e.peekLock()
+	if err != nil{
+		return err
+	}
+	txLock := int64(e.tx.LockTime)
+	if (locktime < lockTimeThreshold) != (txLock < lockTimeThreshold){
+		return fmt.Errorf("%w: lock time %d and transaction lock time %d differ in kind", ErrScriptFailed, locktime, txLock)
+	}
+	if locktime > txLock{
+		return fmt.Errorf("%w: locked until %d", ErrScriptFailed, locktime)
+	}
+	if e.tx.Vin[e.idx].Sequence == SequenceFinal{
+		return fmt.Errorf("%w: input is final, lock time not enforced", ErrScriptFailed)
+	}
+	return nil
+}
+
+// checkSequence fails unless the input's relative lock is at least the
+// one on top of the stack, which is left in place
+func (e *scriptEngine) checkSequence() error{
+	lock, err := e.peekLock()
+	if err != nil{
+		return err
+	}
+	if lock&sequenceLockDisable != 0{
+		return nil
+	}
+	sequence := int64(e.tx.Vin[e.idx].Sequence)
+	if sequence&sequenceLockDisable != 0{
+		return fmt.Errorf("%w: input has no relative lock", ErrScriptFailed)
+	}
+	if lock&sequenceLockTimeFlag != sequence&sequenceLockTimeFlag{
+		return fmt.Errorf("%w: relative locks differ in kind", ErrScriptFailed)
+	}
+	if lock&sequenceLockMask > sequence&sequenceLockMask{
+		return fmt.Errorf("%w: relative lock %d not reached", ErrScriptFailed, lock&sequenceLockMask)
+	}
+	return nil
+}
+
+func (e *scriptEngine) peekLock() (int64, error){
+	if len(e.stack) == 0{
+		return 0, fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+	}
+	lock, err := parseScriptNum(e.stack[len(e.stack)-1], 5)
+	if err != nil{
+		return 0, err
+	}
+	if lock < 0{
+		return 0, fmt.Errorf("%w: negative lock", ErrScriptFailed)
+	}
+	return lock, nil
+}
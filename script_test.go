@@ -0,0 +1,158 @@
+package blockchain_practice
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// spendOf returns an unsigned transaction spending an output locked by
+// lock, and that output
+func spendOf(lock []byte) (*Transaction, TXOutput){
+	tx := &Transaction{nil, []TXInput{{[]byte{1}, 0, nil, SequenceFinal}}, []TXOutput{{5, []byte{1}}}, 0}
+	return tx, TXOutput{10, lock}
+}
+
+func TestP2PKHScript(t *testing.T){
+	wallet, other := NewWallet(), NewWallet()
+	tx, prev := spendOf(NewP2PKHScript(HashPubKey(wallet.PublicKey)))
+	if err := tx.SignInput(0, other.PrivateKey, prev, SigHashAll); err != nil{
+		t.Fatal(err)
+	}
+	if err := VerifyScript(tx, 0, prev); !errors.Is(err, ErrScriptFailed){
+		t.Fatal("someone else's key accepted", err)
+	}
+	if err := tx.SignInput(0, wallet.PrivateKey, prev, SigHashAll); err != nil{
+		t.Fatal(err)
+	}
+	if err := VerifyScript(tx, 0, prev); err != nil{
+		t.Fatal(err)
+	}
+	// unlock scripts may only push data
+	tx.Vin[0].UnlockScript = append(tx.Vin[0].UnlockScript, OP_DUP)
+	if err := VerifyScript(tx, 0, prev); !errors.Is(err, ErrScriptFailed){
+		t.Fatal("opcode in the unlock script accepted", err)
+	}
+}
+
+func TestMultisigScript(t *testing.T){
+	a, b, c := NewWallet(), NewWallet(), NewWallet()
+	lock, err := NewMultisigScript(2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	if err != nil{
+		t.Fatal(err)
+	}
+	tx, prev := spendOf(lock)
+	sigA, err := tx.CreateSignature(0, a.PrivateKey, prev, SigHashAll)
+	if err != nil{
+		t.Fatal(err)
+	}
+	sigC, err := tx.CreateSignature(0, c.PrivateKey, prev, SigHashAll)
+	if err != nil{
+		t.Fatal(err)
+	}
+	tests := []struct{
+		name 	string
+		sigs 	[][]byte
+		ok 		bool
+	}{
+		{"in key order", [][]byte{sigA, sigC}, true},
+		{"out of key order", [][]byte{sigC, sigA}, false},
+		{"same signature twice", [][]byte{sigA, sigA}, false},
+		{"one signature", [][]byte{sigA}, false},
+	}
+	for _,test := range tests{
+		tx.Vin[0].UnlockScript = nil
+		for _,sig := range test.sigs{
+			tx.Vin[0].UnlockScript = pushData(tx.Vin[0].UnlockScript, sig)
+		}
+		if err := VerifyScript(tx, 0, prev); test.ok != (err == nil){
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	if _, err := NewMultisigScript(3, [][]byte{a.PublicKey, b.PublicKey}); err == nil{
+		t.Error("more signatures required than keys")
+	}
+}
+
+func TestHashLockScript(t *testing.T){
+	wallet := NewWallet()
+	secret := []byte("open sesame")
+	hash := sha256.Sum256(secret)
+	tx, prev := spendOf(NewHashLockScript(hash[:], HashPubKey(wallet.PublicKey)))
+	sig, err := tx.CreateSignature(0, wallet.PrivateKey, prev, SigHashAll)
+	if err != nil{
+		t.Fatal(err)
+	}
+	for preimage, ok := range map[string]bool{"open sesame": true, "open barley": false}{
+		tx.Vin[0].UnlockScript = pushData(pushData(pushData(nil, sig), wallet.PublicKey), []byte(preimage))
+		if err := VerifyScript(tx, 0, prev); ok != (err == nil){
+			t.Errorf("%q: %v", preimage, err)
+		}
+	}
+}
+
+func TestTimeLockScript(t *testing.T){
+	wallet := NewWallet()
+	for _,lockTime := range []int64{100, lockTimeThreshold + 100}{
+		tx, prev := spendOf(NewTimeLockScript(lockTime, HashPubKey(wallet.PublicKey)))
+		tests := []struct{
+			name 		string
+			lockTime 	int64
+			sequence 	uint32
+			ok 			bool
+		}{
+			{"before the lock", lockTime - 1, 0, false},
+			{"final input", lockTime, SequenceFinal, false},
+			{"height against time", lockTime ^ lockTimeThreshold, 0, false},
+			{"at the lock", lockTime, 0, true},
+		}
+		for _,test := range tests{
+			tx.LockTime = uint32(test.lockTime)
+			tx.Vin[0].Sequence = test.sequence
+			if err := tx.SignInput(0, wallet.PrivateKey, prev, SigHashAll); err != nil{
+				t.Fatal(err)
+			}
+			if err := VerifyScript(tx, 0, prev); test.ok != (err == nil){
+				t.Errorf("lock %d, %s: %v", lockTime, test.name, err)
+			}
+		}
+	}
+}
+
+func TestScriptNum(t *testing.T){
+	for _,n := range []int64{0, 1, 16, 17, -1, 127, 128, 255, 256, -255, lockTimeThreshold, 1 << 32}{
+		got, err := parseScriptNum(scriptNum(n), 5)
+		if err != nil || got != n{
+			t.Errorf("%d: got %d, %v", n, got, err)
+		}
+	}
+	if _, err := parseScriptNum(scriptNum(1 << 40), 5); err == nil{
+		t.Error("six byte number accepted")
+	}
+}
+
+func TestScriptConditionals(t *testing.T){
+	tests := []struct{
+		script 	[]byte
+		top 		byte
+		ok 		bool
+	}{
+		{[]byte{OP_0, OP_IF, OP_1, OP_ELSE, OP_1NEGATE, OP_ENDIF}, 0x81, true},
+		{[]byte{OP_1, OP_IF, OP_1, OP_ELSE, OP_1NEGATE, OP_ENDIF}, 0x01, true},
+		{[]byte{OP_1, OP_IF}, 0, false},
+		{[]byte{OP_ENDIF}, 0, false},
+	}
+	for _,test := range tests{
+		e := &scriptEngine{}
+		err := e.execute(test.script)
+		if !test.ok{
+			if err == nil{
+				t.Errorf("%s: unbalanced conditional accepted", DisasmScript(test.script))
+			}
+			continue
+		}
+		if err != nil || len(e.stack) != 1 || e.stack[0][0] != test.top{
+			t.Errorf("%s: %v %x", DisasmScript(test.script), err, e.stack)
+		}
+	}
+}
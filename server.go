@@ -1,27 +1,130 @@
 package blockchain_practice
 
 import (
+	"bufio"
 	"fmt"
 	"net"
-	"io"
 	"bytes"
 	"log"
 	"encoding/gob"
 	"encoding/hex"
-	"io/ioutil"
+	"math/big"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
 	protocol = "tcp"
-	nodeVersion = 1
+	nodeVersion = 3
 	commandLength = 12
 )
 
 var nodeAddress string
 var miningAddress string
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit = []byte{}
-var mempool = make(map[string]Transaction)
+var seedNodes = []string{"localhost:3000"}
+var peerManager *PeerManager
+var blockSync *syncManager
+var mempool = newTxPool()
+
+// maxMempoolTxs caps the transactions a node keeps waiting to be mined
+const maxMempoolTxs = 5000
+
+var ErrMempoolFull = errors.New("mempool full")
+
+// txPool holds the transactions waiting to be mined, by hex id, and which
+// pooled transaction spends each outpoint. Every peer is served from its
+// own goroutine, so all access goes through mu.
+type txPool struct{
+	mu 		sync.Mutex
+	txs 		map[string]Transaction
+	spends 	map[string]string
+}
+
+func newTxPool() *txPool{
+	return &txPool{txs: make(map[string]Transaction), spends: make(map[string]string)}
+}
+
+func (pool *txPool) get(id []byte) (Transaction, bool){
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	tx, ok := pool.txs[hex.EncodeToString(id)]
+	return tx, ok
+}
+
+// add pools tx without checks, for transactions that were already in a
+// block
+func (pool *txPool) add(tx Transaction){
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	id := hex.EncodeToString(tx.HashID)
+	pool.txs[id] = tx
+	for _,in := range tx.Vin{
+		pool.spends[fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)] = id
+	}
+}
+
+// accept pools a transaction received from a peer and reports whether it
+// was new. It fails if tx spends an outpoint a pooled transaction already
+// spends or the pool is full.
+func (pool *txPool) accept(tx Transaction) (bool, error){
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	id := hex.EncodeToString(tx.HashID)
+	if _, ok := pool.txs[id]; ok{
+		return false, nil
+	}
+	if len(pool.txs) >= maxMempoolTxs{
+		return false, ErrMempoolFull
+	}
+	for _,in := range tx.Vin{
+		outpoint := fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)
+		if other, ok := pool.spends[outpoint]; ok{
+			return false, fmt.Errorf("%w: %s: %s already spent by pooled %s", ErrInvalidTx, id, outpoint, other)
+		}
+	}
+	pool.txs[id] = tx
+	for _,in := range tx.Vin{
+		pool.spends[fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)] = id
+	}
+	return true, nil
+}
+
+func (pool *txPool) remove(id []byte){
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	key := hex.EncodeToString(id)
+	tx, ok := pool.txs[key]
+	if !ok{
+		return
+	}
+	delete(pool.txs, key)
+	for _,in := range tx.Vin{
+		outpoint := fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)
+		if pool.spends[outpoint] == key{
+			delete(pool.spends, outpoint)
+		}
+	}
+}
+
+func (pool *txPool) count() int{
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return len(pool.txs)
+}
+
+// list returns a copy of the pool's transactions
+func (pool *txPool) list() []Transaction{
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	var txs []Transaction
+	for _,tx := range pool.txs{
+		txs = append(txs, tx)
+	}
+	return txs
+}
 
 type addr struct{
 	AddrList []string
@@ -32,8 +135,14 @@ type block struct{
 	Block []byte
 }
 
-type getblocks struct{
+type getheaders struct{
+	AddrFrom string
+	Locator [][]byte
+}
+
+type headers struct{
 	AddrFrom string
+	Headers [][]byte
 }
 
 type getdata struct{
@@ -42,12 +151,37 @@ type getdata struct{
 	ID []byte
 }
 
+type notfound struct{
+	AddrFrom string
+	Type string
+	ID []byte
+}
+
+type getutxohash struct{
+	AddrFrom string
+}
+
+type utxohash struct{
+	AddrFrom string
+	BlockHash []byte
+	Height int
+	Hash []byte
+}
+
 type inv struct{
 	AddrFrom string
 	Type string
 	Items [][]byte
 }
 
+type ping struct{
+	Nonce uint64
+}
+
+type pong struct{
+	Nonce uint64
+}
+
 type tx struct{
 	AddrFrom string
 	Transaction []byte
@@ -56,312 +190,602 @@ type tx struct{
 type verzion struct{
 	Version int
 	BestHeight int
+	BestWork []byte
 	AddrFrom string
 }
 
 func commandToBytes(command string) []byte{
 	var data [commandLength]byte
-	for i,c := range command{
-		data[i] = byte(c)
-	}
+	copy(data[:], command)
 	return data[:]
 }
 
-func bytesToCommand(data []byte) string{
-	var command []byte
-	for _,b := range data{
-		command = append(command, b)
+// bytesToCommand strips the zero padding, which must not be followed by
+// anything else
+func bytesToCommand(data []byte) (string, error){
+	n := bytes.IndexByte(data, 0)
+	if n < 0{
+		n = len(data)
 	}
-	return fmt.Sprintf("%s", command)
-}
-
-func extractCommand(request []byte) []byte{
-	return request[:commandLength]
-}
-
-func requestBlocks() {
-	for _,node := range knownNodes{
-		sendGetBlocks(node)
+	if n == 0 || !bytes.Equal(data[n:], make([]byte, len(data)-n)){
+		return "", fmt.Errorf("%w: %q", ErrBadCommand, data)
 	}
+	return string(data[:n]), nil
 }
 
 func sendAddr(address string){
-	nodes := addr{knownNodes}
+	nodes := addr{peerManager.KnownAddresses()}
 	nodes.AddrList = append(nodes.AddrList, nodeAddress)
 	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
-	sendData(address, request)
+	sendMessage(address, "addr", payload)
 }
 
-func sendBlock(address string, b *Block){
-	data := block{nodeAddress, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
-	sendData(address, request)
-}
-
-func sendData(address string, data []byte){
-	conn, err := net.Dial(protocol, address)
+// sendMessage queues a message on the connection to address, opening one
+// if needed. The peer manager forgets nodes that keep failing.
+func sendMessage(address, command string, payload []byte){
+	p, err := peerManager.Connect(address)
 	if err != nil{
-		fmt.Printf("%s unavailable", address)
-		var updatedNodes []string
-		for _,node := range knownNodes{
-			if node != address{
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-		knownNodes = updatedNodes
+		fmt.Printf("%s unavailable: %s\n", address, err)
 		return
 	}
-	defer conn.Close()
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+	if !p.queue(command, payload){
+		fmt.Printf("%s unavailable\n", address)
 	}
 }
 
 func sendInv(address, kind string, items [][]byte){
 	inventory := inv{nodeAddress, kind, items}
 	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
-	sendData(address, request)
-}
-
-func sendGetBlocks(address string) {
-	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
-	sendData(address, request)
+	sendMessage(address, "inv", payload)
 }
 
 func sendGetData(address, kind string, id []byte){
 	payload := gobEncode(getdata{nodeAddress, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
-	sendData(address, request)
+	sendMessage(address, "getdata", payload)
 }
 
-func sendTx(address string, Tx *Transaction){
-	data := tx{nodeAddress, Tx.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
-	sendData(address, request)
+// submitTx hands a transaction to the node at address over a connection of
+// its own, for commands that run without a server
+func submitTx(address string, Tx *Transaction) error{
+	conn, err := net.DialTimeout(protocol, address, dialTimeout)
+	if err != nil{
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = writeMessage(conn, &message{"version", gobEncode(verzion{nodeVersion, 0, nil, ""})})
+	if err != nil{
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for gotVersion, gotVerack := false, false; !gotVersion || !gotVerack;{
+		msg, err := readMessageLimit(r, maxHandshakePayload)
+		if err != nil{
+			return err
+		}
+		switch msg.command{
+		case "version":
+			gotVersion = true
+			err = writeMessage(conn, &message{"verack", nil})
+		case "verack":
+			gotVerack = true
+		}
+		if err != nil{
+			return err
+		}
+	}
+	return writeMessage(conn, &message{"tx", gobEncode(tx{"", Tx.Serialize()})})
 }
 
-func sendVersion(address string, bc *Blockchain) {
+func versionPayload(bc *Blockchain) []byte{
 	bestHeight := bc.GetBestHeight()
-	payload := gobencode(verzion{nodeVersion, bestHeight, nodeAddress})
-	request := append(commandToBytes("version"), payload...)
-	sendData(address, request)
+	bestWork := bc.GetBestWork()
+	return gobEncode(verzion{nodeVersion, bestHeight, bestWork.Bytes(), nodeAddress})
 }
 
-func handleAddr(request []byte){
+func handleAddr(request []byte) error{
 	var buf bytes.Buffer
 	var payload addr
-	buf.Write(request[commandLength:])
+	buf.Write(request)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("addr", err)
 	}
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("%d known nodes\n", len(knownNodes))
-	requestBlocks()
+	peerManager.AddAddresses(payload.AddrList...)
+	fmt.Printf("%d known nodes\n", len(peerManager.KnownAddresses()))
+	return nil
 }
 
-func handleBlock(request []byte, bc *Blockchain){
+func handleBlock(p *peer, request []byte, bc *Blockchain) error{
 	var buf bytes.Buffer
 	var payload block
-	buf.Write(request[commandLength:])
+	buf.Write(request)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("block", err)
 	}
 	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	block, err := DeserializeBlock(blockData)
+	if err != nil{
+		return malformed("block", err)
+	}
 	fmt.Println("received new block")
-	bc.AddBlock(block)
+	defer blockSync.gotBlock(block.Hash)
+	err = acceptBlock(bc, block)
+	if errors.Is(err, ErrUnknownParent) && maybeOrphan(block){
+		orphans.add(block)
+		// during sync the parent is usually on its way already
+		missing := orphans.missingAncestor(block.Hash)
+		if !blockSync.wanted(missing){
+			fmt.Printf("block %x is an orphan, requesting %x\n", block.Hash, missing)
+			p.queue("getdata", gobEncode(getdata{nodeAddress, "block", missing}))
+		}
+		return nil
+	}
+	if err != nil{
+		blockSync.forget(block.Hash)
+		return err
+	}
+	// connect any orphans that were waiting for this block
+	parents := [][]byte{block.Hash}
+	for len(parents) > 0{
+		children := orphans.takeChildren(parents[0])
+		parents = parents[1:]
+		for _,child := range children{
+			err := acceptBlock(bc, child)
+			if err != nil{
+				fmt.Println(err)
+				continue
+			}
+			parents = append(parents, child.Hash)
+		}
+	}
+	return nil
+}
+
+// acceptBlock adds block to the chain and keeps the mempool in step with it
+func acceptBlock(bc *Blockchain, block *Block) error{
+	orphaned, err := bc.AddBlock(block)
+	if err != nil{
+		return err
+	}
 	fmt.Printf("block %x added\n", block.Hash)
-	if len(blocksInTransit) > 0{
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	}else{
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+	for _,tx := range block.Transactions{
+		mempool.remove(tx.HashID)
+	}
+	for _,tx := range orphaned{
+		mempool.add(*tx)
 	}
+	return nil
 }
 
-func handleInv(request []byte, bc *Blockchain){
+func handleInv(p *peer, request []byte, bc *Blockchain) error{
 	var buf bytes.Buffer
 	var payload inv
-	buf.Write(request[commandLength:])
+	buf.Write(request)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("inv", err)
 	}
 	fmt.Printf("received inventory with %d %s\n", len(payload.Items), payload.Type)
+	if len(payload.Items) == 0{
+		return malformed("inv", errors.New("no items"))
+	}
 	if payload.Type == "block"{
-		blocksInTransit = payload.Items
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-		newInTransit := [][]byte{}
-		for _,b := range blocksInTransit{
-			if bytes.Compare(b, blockHash) != 0{
-				newInTransit = append(newInTransit, b)
+		// announced blocks are fetched once their headers are checked
+		for _,hash := range payload.Items{
+			if _, err := bc.GetHeader(hash); err != nil{
+				p.queue("getheaders", gobEncode(getheaders{nodeAddress, bc.BlockLocator(nil)}))
+				break
 			}
 		}
-		blocksInTransit = newInTransit
 	}
 	if payload.Type == "tx"{
 		txid := payload.Items[0]
-		if mempool[hex.EncodeToString(txid)].HashID == nil{
-			sendGetData(payload.AddrFrom, "tx", txid)
+		if _, ok := mempool.get(txid); !ok{
+			p.queue("getdata", gobEncode(getdata{nodeAddress, "tx", txid}))
 		}
 	}
+	return nil
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain){
+func handleGetHeaders(p *peer, request []byte, bc *Blockchain) error{
 	var buf bytes.Buffer
-	var payload getblocks
-	buf.Write(request[commandLength:])
+	var payload getheaders
+	buf.Write(request)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("getheaders", err)
+	}
+	var data [][]byte
+	for _,header := range bc.HeadersAfter(payload.Locator, maxHeadersPerMsg){
+		data = append(data, header.Serialize())
+	}
+	p.queue("headers", gobEncode(headers{nodeAddress, data}))
+	return nil
+}
+
+// handleHeaders stores the headers a peer sent, asks it for more if it
+// sent a full batch and starts downloading the blocks when they lead to a
+// chain with more work than ours
+func handleHeaders(p *peer, request []byte, bc *Blockchain) error{
+	var buf bytes.Buffer
+	var payload headers
+	buf.Write(request)
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil{
+		return malformed("headers", err)
+	}
+	if len(payload.Headers) > maxHeadersPerMsg{
+		return malformed("headers", fmt.Errorf("%d headers", len(payload.Headers)))
 	}
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	var received []*BlockHeader
+	for _,data := range payload.Headers{
+		header, err := DeserializeHeader(data)
+		if err != nil{
+			return malformed("headers", err)
+		}
+		received = append(received, header)
+	}
+	if len(received) == 0{
+		return nil
+	}
+	work, side, err := bc.AddHeaders(received)
+	if errors.Is(err, ErrUnknownParent){
+		// the peer guessed our chain wrong, let it try again from the tip,
+		// but a peer that keeps ignoring our locator is charged for it
+		if n := p.pm.headersConnected(p, false); n > maxUnconnectingHeaders{
+			return fmt.Errorf("%w: %d times in a row: %s", ErrUnconnectingHeaders, n, err)
+		}
+		p.queue("getheaders", gobEncode(getheaders{nodeAddress, bc.BlockLocator(nil)}))
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+	p.pm.headersConnected(p, true)
+	if n := p.pm.sideHeaders(p, side); n > maxSideHeaders{
+		return fmt.Errorf("%w: %d", ErrTooManySideHeaders, n)
+	}
+	last := received[len(received)-1]
+	p.pm.sawHeight(p, last.Height)
+	blockSync.announced(p, last.Hash())
+	fmt.Printf("%d headers from %s, up to height %d\n", len(received), p, last.Height)
+	if len(received) == maxHeadersPerMsg{
+		p.queue("getheaders", gobEncode(getheaders{nodeAddress, bc.BlockLocator(last.Hash())}))
+	}
+	if work.Cmp(bc.GetBestWork()) > 0{
+		blockSync.syncTo(last.Hash(), work)
+	}
+	return nil
 }
 
-func handleGetData(request []byte, bc *Blockchain){
+func handleGetData(p *peer, request []byte, bc *Blockchain) error{
 	var buf bytes.Buffer
 	var payload getdata
-	buf.Write(request[commandLength:])
+	buf.Write(request)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("getdata", err)
 	}
+	// what we do not have is answered with notfound so the peer can ask
+	// elsewhere instead of waiting for a reply that never comes
 	if payload.Type == "block"{
-		block, err := bc.GetBlock([]byte(payload.ID))
+		b, err := bc.GetBlock([]byte(payload.ID))
 		if err != nil{
-			log.Panic(err)
+			// a node started from a snapshot lacks older blocks
+			fmt.Printf("%x: %s\n", payload.ID, err)
+			p.queue("notfound", gobEncode(notfound{nodeAddress, payload.Type, payload.ID}))
+			return nil
 		}
-		sendBlock(payload.AddrFrom, &block)
+		p.queue("block", gobEncode(block{nodeAddress, b.Serialize()}))
 	}
 	if payload.Type == "tx"{
 		txid := hex.EncodeToString(payload.ID)
-		tx := mempool[txid]
-		sendTx(payload.AddrFrom, &tx)
+		t, ok := mempool.get(payload.ID)
+		if !ok{
+			fmt.Printf("transaction %s not in the mempool\n", txid)
+			p.queue("notfound", gobEncode(notfound{nodeAddress, payload.Type, payload.ID}))
+			return nil
+		}
+		p.queue("tx", gobEncode(tx{nodeAddress, t.Serialize()}))
+	}
+	return nil
+}
+
+// handleNotFound hands a block p could not send to another peer
+func handleNotFound(p *peer, request []byte) error{
+	var buf bytes.Buffer
+	var payload notfound
+	buf.Write(request)
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil{
+		return malformed("notfound", err)
+	}
+	if payload.Type == "block"{
+		blockSync.notFound(p, payload.ID)
 	}
+	return nil
 }
 
-func handleTx(request []byte, bc *Blockchain){
+func handleTx(p *peer, request []byte, bc *Blockchain) error{
 	var buf bytes.Buffer
 	var payload tx
-	buf.Write(request[commandLength:])
+	buf.Write(request)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("tx", err)
 	}
 	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.HashID)] = tx
-	if nodeAddress == knownNodes[0]{
-		for _,node := range knownNodes{
-			if node != nodeAddress && node != payload.AddrFrom{
-				sendInv(node, "tx", [][]byte{tx.HashID})
-			}
+	tx, err := DeserializeTransaction(txData)
+	if err != nil{
+		return malformed("tx", err)
+	}
+	if err := checkPoolTx(bc, &tx); err != nil{
+		return err
+	}
+	added, err := mempool.accept(tx)
+	if errors.Is(err, ErrMempoolFull){
+		fmt.Printf("mempool full, dropping %x\n", tx.HashID)
+		return nil
+	}
+	if err != nil || !added{
+		return err
+	}
+	if nodeAddress == seedNodes[0]{
+		announce := gobEncode(inv{nodeAddress, "tx", [][]byte{tx.HashID}})
+		for _,other := range p.pm.others(p){
+			other.queue("inv", announce)
 		}
 	}else{
-		if len(mempool) >= 2 && len(miningAddress) > 0{
+		if mempool.count() >= 2 && len(miningAddress) > 0{
 			MineTransactions:
-				var txs []*Transaction
-				for id := range mempool{
-					tx := mempool[id]
-					if bc.VerifyTransaction(&tx){
-						txs = append(txs, &tx)
-					}
-				}
+				txs, fees := blockTemplate(bc)
 				if len(txs) == 0{
 					fmt.Println("all transactions invald")
-					return
+					return nil
+				}
+				cbtx := NewCoinbaseTX(miningAddress, "", bc.GetBestHeight()+1, fees)
+				txs = append([]*Transaction{cbtx}, txs...)
+				newBlock, err := bc.MineBlock(txs)
+				if errors.Is(err, ErrStaleTip){
+					// a peer's block arrived first, build on it instead
+					goto MineTransactions
+				}
+				if err != nil{
+					log.Panic(err)
 				}
-				cbtx := NewCoinbase(miningAddress, "")
-				txs = append(txs, cbtx)
-				newBlock := bc.MineBlock(txs)
-				UTXOSet := UTXOSet{bc}
-				UTXOSet.Reindex()
 				fmt.Println("new block mined")
 				for _,tx := range txs {
-					id := hex.EncodeToString(tx.HashID)
-					delete(mempool, id)
+					mempool.remove(tx.HashID)
 				}
-				for _,node := range knownNodes{
-					if node != nodeAddress{
-						sendInv(node, "block", [][]byte{newBlock.Hash})
-					}
+				for _,node := range peerManager.Peers(){
+					sendInv(node, "block", [][]byte{newBlock.Hash})
 				}
-				if len(mempool) > 0{
+				if mempool.count() > 0{
 					goto MineTransactions
 				}
 		}
 	}
+	return nil
+}
+
+// checkPoolTx runs the checks a transaction from a peer has to pass before
+// it is pooled and relayed: it must be able to go into the next block
+func checkPoolTx(bc *Blockchain, tx *Transaction) error{
+	if tx.IsCoinbase(){
+		return fmt.Errorf("%w: %x: coinbase outside a block", ErrInvalidTx, tx.HashID)
+	}
+	if err := checkTransaction(tx); err != nil{
+		return fmt.Errorf("%w: %x: %s", ErrInvalidTx, tx.HashID, err)
+	}
+	if err := bc.CheckLocks(tx); err != nil{
+		return fmt.Errorf("%w: %x: %s", ErrInvalidTx, tx.HashID, err)
+	}
+	fee, err := UTXOSet{bc}.TransactionFee(tx)
+	if err != nil{
+		return fmt.Errorf("%w: %x: %s", ErrInvalidTx, tx.HashID, err)
+	}
+	if fee < 0{
+		return fmt.Errorf("%w: %x: spends %d more than its inputs", ErrInvalidTx, tx.HashID, -fee)
+	}
+	if !bc.VerifyTransaction(tx){
+		return fmt.Errorf("%w: %x: immature input or bad signature", ErrInvalidTx, tx.HashID)
+	}
+	return nil
 }
 
-func handleVersion(request []byte, bc *Blockchain){
+// blockTemplate picks the valid mempool transactions, highest fee rate
+// first, and returns them with the fees they pay. Of two transactions
+// spending the same output only the better paying one is taken.
+func blockTemplate(bc *Blockchain) ([]*Transaction, int){
+	type candidate struct{
+		tx 		*Transaction
+		fee 	int
+		rate 	int
+	}
+	UTXOSet := UTXOSet{bc}
+	var candidates []candidate
+	pooled := mempool.list()
+	for i := range pooled{
+		tx := &pooled[i]
+		fee, err := UTXOSet.TransactionFee(tx)
+		if err != nil || fee < 0{
+			continue
+		}
+		if bc.VerifyTransaction(tx){
+			candidates = append(candidates, candidate{tx, fee, FeeRate(tx, fee)})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool{
+		return candidates[i].rate > candidates[j].rate
+	})
+	var txs []*Transaction
+	fees := 0
+	spent := make(map[string]bool)
+	Candidates:
+	for _,c := range candidates{
+		for _,in := range c.tx.Vin{
+			if spent[fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)]{
+				continue Candidates
+			}
+		}
+		for _,in := range c.tx.Vin{
+			spent[fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)] = true
+		}
+		txs = append(txs, c.tx)
+		fees += c.fee
+	}
+	return txs, fees
+}
+
+func handleVersion(p *peer, request []byte, bc *Blockchain) error{
 	var buf bytes.Buffer
 	var payload verzion
-	buf.Write(request[commandLength:])
+	buf.Write(request)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("version", err)
 	}
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
-	if myBestHeight < foreignerBestHeight{
-		sendGetBlocks(payload.AddrFrom)
-	}else if myBestHeight > foreignerBestHeight{
-		sendVersion(payload.AddrFrom,bc)
+	if !p.pm.gotVersion(p, payload){
+		return nil
 	}
-	if !nodeIsKnown(payload.AddrFrom){
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	myBestWork := bc.GetBestWork()
+	foreignerBestWork := new(big.Int).SetBytes(payload.BestWork)
+	fmt.Printf("peer %s at height %d, work %s\n", p, payload.BestHeight, foreignerBestWork)
+	// both sides sent their version, so a peer behind us asks for headers
+	// itself and only the one behind needs to act
+	if myBestWork.Cmp(foreignerBestWork) < 0{
+		p.queue("getheaders", gobEncode(getheaders{nodeAddress, bc.BlockLocator(nil)}))
+	}else if myBestWork.Cmp(foreignerBestWork) == 0{
+		p.queue("getutxohash", gobEncode(getutxohash{nodeAddress}))
 	}
+	return nil
 }
 
-func handleConnection(conn net.Conn, bc *Blockchain){
-	request, err := ioutil.ReadAll(conn)
+func handlePing(p *peer, request []byte) error{
+	var buf bytes.Buffer
+	var payload ping
+	buf.Write(request)
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
 	if err != nil{
-		log.Panic(err)
+		return malformed("ping", err)
+	}
+	p.queue("pong", gobEncode(pong{payload.Nonce}))
+	return nil
+}
+
+func handlePong(p *peer, request []byte) error{
+	var buf bytes.Buffer
+	var payload pong
+	buf.Write(request)
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil{
+		return malformed("pong", err)
+	}
+	p.pm.gotPong(p, payload.Nonce)
+	return nil
+}
+
+func handleGetUTXOHash(p *peer, request []byte, bc *Blockchain) error{
+	var buf bytes.Buffer
+	var payload getutxohash
+	buf.Write(request)
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil{
+		return malformed("getutxohash", err)
+	}
+	h := UTXOSet{bc}.Hash()
+	p.queue("utxohash", gobEncode(utxohash{nodeAddress, h.BlockHash, h.Height, h.Hash}))
+	return nil
+}
+
+// handleUTXOHash compares a peer's UTXO set hash with ours when both are
+// at the same tip
+func handleUTXOHash(request []byte, bc *Blockchain) error{
+	var buf bytes.Buffer
+	var payload utxohash
+	buf.Write(request)
+	dec := gob.NewDecoder(&buf)
+	err := dec.Decode(&payload)
+	if err != nil{
+		return malformed("utxohash", err)
+	}
+	mine := UTXOSet{bc}.Hash()
+	switch {
+	case !bytes.Equal(mine.BlockHash, payload.BlockHash):
+		fmt.Printf("peer %s UTXO set is at %x, height %d, not our tip\n", payload.AddrFrom, payload.BlockHash, payload.Height)
+	case bytes.Equal(mine.Hash, payload.Hash):
+		fmt.Printf("peer %s UTXO set matches ours at height %d: %x\n", payload.AddrFrom, payload.Height, payload.Hash)
+	default:
+		fmt.Printf("peer %s UTXO set differs at height %d: %x, ours %x\n", payload.AddrFrom, payload.Height, payload.Hash, mine.Hash)
+	}
+	return nil
+}
+
+// handleMessage runs the handler for a message read from p and charges
+// the peer for whatever it sent that was invalid
+func handleMessage(p *peer, msg *message, bc *Blockchain){
+	request := msg.payload
+	fmt.Printf("received %s command\n", msg.command)
+	p.pm.touch(p)
+	if msg.command != "version" && msg.command != "verack" && !p.pm.handshakeDone(p){
+		p.pm.drop(p, "%s before the handshake", msg.command)
+		return
 	}
-	command := bytesToCommand(request[:commandLength])
-	fmt.Printf("received %s command\n", command)
-	switch command{
+	var err error
+	switch msg.command{
 	case "addr":
-		handleAddr(request)
+		err = handleAddr(request)
 	case "block":
-		handleBlock(request, bc)
+		err = handleBlock(p, request, bc)
 	case "inv":
-		handleInv(request, bc)
-	case "getblocks":
-		handleGetBlocks(request, bc)
+		err = handleInv(p, request, bc)
+	case "getheaders":
+		err = handleGetHeaders(p, request, bc)
+	case "headers":
+		err = handleHeaders(p, request, bc)
 	case "getdata":
-		handleGetData(request, bc)
+		err = handleGetData(p, request, bc)
+	case "notfound":
+		err = handleNotFound(p, request)
 	case "tx":
-		handleTx(request, bc)
+		err = handleTx(p, request, bc)
 	case "version":
-		handleVersion(request, bc)
+		err = handleVersion(p, request, bc)
+	case "verack":
+		p.pm.gotVerack(p)
+	case "ping":
+		err = handlePing(p, request)
+	case "pong":
+		err = handlePong(p, request)
+	case "getutxohash":
+		err = handleGetUTXOHash(p, request, bc)
+	case "utxohash":
+		err = handleUTXOHash(request, bc)
 	default:
 		fmt.Println("unknown command")
 	}
-	conn.Close()
+	if err != nil{
+		fmt.Printf("%s from %s: %s\n", msg.command, p, err)
+		p.pm.misbehaving(p, banScore(err), err)
+	}
 }
 
 func StartServer(nodeID, minerAddress string){
-	nodeAddress = fmt.Sprint("localhost:%s", nodeID)
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	miningAddress = minerAddress
 	ln,err := net.Listen(protocol, nodeAddress)
 	if err != nil{
@@ -369,16 +793,43 @@ func StartServer(nodeID, minerAddress string){
 	}
 	defer ln.Close()
 	bc := NewBlockChain(nodeID)
-	if nodeAddress != knownNodes[0]{
-		sendVersion(knownNodes[0], bc)
+	peerManager = NewPeerManager(bc, seedNodes)
+	blockSync = newSyncManager(peerManager)
+	go peerManager.Run()
+	go blockSync.Run()
+	if bc.SnapshotPending(){
+		go validateSnapshot(bc)
 	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil{
 			log.Panic(err)
 		}
-		go handleConnection(conn, bc)
+		peerManager.Accept(conn)
+	}
+}
+
+// validateSnapshot checks the UTXO snapshot the node started from,
+// downloading the historical blocks it needs from known nodes
+func validateSnapshot(bc *Blockchain){
+	fmt.Println("validating the UTXO snapshot in the background")
+	err := bc.ValidateSnapshot(func(hash []byte){
+		for _,node := range peerManager.Peers(){
+			sendGetData(node, "block", hash)
+		}
+	})
+	// nothing built on an unchecked or bad UTXO set can be trusted
+	if errors.Is(err, ErrBlockUnavailable){
+		fmt.Printf("UTXO snapshot could not be validated: %s\n", err)
+		fmt.Println("stopping the node, restart it to resume validation")
+		os.Exit(1)
 	}
+	if err != nil{
+		fmt.Printf("UTXO snapshot failed validation: %s\n", err)
+		fmt.Println("stopping the node")
+		os.Exit(1)
+	}
+	fmt.Println("UTXO snapshot validated")
 }
 
 func gobEncode(data interface{}) []byte{
@@ -389,13 +840,4 @@ func gobEncode(data interface{}) []byte{
 		log.Panic(err)
 	}
 	return buf.Bytes()
-}
-
-func nodeIsKnown(addr string) bool{
-	for _,node := range knownNodes{
-		if node == addr{
-			return true
-		}
-	}
-	return false
 }
\ No newline at end of file
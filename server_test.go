@@ -0,0 +1,44 @@
+package blockchain_practice
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTxPoolAccept(t *testing.T){
+	pool := newTxPool()
+	tx := testTransaction()
+	if added, err := pool.accept(tx); !added || err != nil{
+		t.Fatal(added, err)
+	}
+	if added, err := pool.accept(tx); added || err != nil{
+		t.Fatal("known transaction", added, err)
+	}
+	// another transaction spending the same outpoint is refused
+	conflict := testTransaction()
+	conflict.Vout[0].Value--
+	conflict.HashID = conflict.Hash()
+	if _, err := pool.accept(conflict); !errors.Is(err, ErrInvalidTx){
+		t.Fatal("conflict accepted", err)
+	}
+	// once the first is mined its outputs can be spent again
+	pool.remove(tx.HashID)
+	if added, err := pool.accept(conflict); !added || err != nil{
+		t.Fatal(added, err)
+	}
+	for i := pool.count(); i < maxMempoolTxs; i++{
+		filler := testTransaction()
+		filler.Vin = filler.Vin[:1]
+		filler.Vin[0].PreOutIndex = i
+		filler.HashID = filler.Hash()
+		if _, err := pool.accept(filler); err != nil{
+			t.Fatal(err)
+		}
+	}
+	extra := testTransaction()
+	extra.Vin[0].PreOutIndex = -2
+	extra.HashID = extra.Hash()
+	if _, err := pool.accept(extra); err != ErrMempoolFull{
+		t.Fatal("full pool grew", err)
+	}
+}
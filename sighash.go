@@ -0,0 +1,80 @@
+package blockchain_practice
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// SigHashType selects which parts of a transaction a signature commits to.
+// It is appended to every signature as a single byte.
+type SigHashType byte
+
+const (
+	SigHashAll SigHashType = 0x01
+	SigHashNone SigHashType = 0x02
+	SigHashSingle SigHashType = 0x03
+	SigHashAnyoneCanPay SigHashType = 0x80
+
+	sigHashMask = 0x1f
+)
+
+var ErrBadSigHashType = errors.New("bad signature hash type")
+
+func (t SigHashType) valid() bool{
+	base := t &^ SigHashAnyoneCanPay
+	return base == SigHashAll || base == SigHashNone || base == SigHashSingle
+}
+
+// SignatureHash returns the digest signed by input idx, which spends
+// prevOut. It is a double SHA-256 over the canonical serialization of a
+// copy of tx in which every unlock script is cleared and input idx carries
+// prevOut's lock script instead, followed by the hash type. To spend a
+// pay-to-script-hash output, pass the redeem script as prevOut's lock.
+// The hash types:
+//
+//	ALL            commits to every input and output
+//	NONE           commits to no outputs, anyone may redirect them
+//	SINGLE         commits only to the output at the same index as idx
+//	ANYONECANPAY   combined with the above, commits only to input idx so
+//	               others can add inputs of their own
+func (tx *Transaction) SignatureHash(idx int, prevOut TXOutput, hashType SigHashType) ([]byte, error){
+	if !hashType.valid(){
+		return nil, ErrBadSigHashType
+	}
+	if idx < 0 || idx >= len(tx.Vin){
+		return nil, fmt.Errorf("input %d out of range", idx)
+	}
+	txcopy := tx.TrimmedCopy()
+	txcopy.Vin[idx].UnlockScript = prevOut.LockScript
+
+	// without ALL the other inputs' sequences are not committed to either,
+	// so their owners can still change them
+	for i := range txcopy.Vin{
+		if i != idx && hashType&sigHashMask != SigHashAll{
+			txcopy.Vin[i].Sequence = 0
+		}
+	}
+	switch hashType & sigHashMask{
+	case SigHashNone:
+		txcopy.Vout = nil
+	case SigHashSingle:
+		if idx >= len(tx.Vout){
+			return nil, fmt.Errorf("%w: SINGLE input %d has no matching output", ErrBadSigHashType, idx)
+		}
+		txcopy.Vout = txcopy.Vout[:idx+1]
+		for i:=0;i<idx;i++{
+			txcopy.Vout[i] = TXOutput{-1, nil}
+		}
+	}
+	if hashType&SigHashAnyoneCanPay != 0{
+		txcopy.Vin = txcopy.Vin[idx:idx+1]
+	}
+
+	e := &encoder{}
+	txcopy.encode(e)
+	e.writeUint32(uint32(hashType))
+	first := sha256.Sum256(e.Bytes())
+	second := sha256.Sum256(first[:])
+	return second[:], nil
+}
@@ -0,0 +1,80 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSignatureHashCommitments(t *testing.T){
+	prev := TXOutput{10, []byte{1}}
+	base := func() *Transaction{
+		return &Transaction{nil, []TXInput{{[]byte{1}, 0, nil, SequenceFinal}, {[]byte{2}, 0, nil, SequenceFinal}}, []TXOutput{{5, []byte{1}}, {4, []byte{2}}}, 0}
+	}
+	changes := []struct{
+		name 	string
+		change 	func(tx *Transaction)
+	}{
+		{"earlier output", func(tx *Transaction){ tx.Vout[0].Value++ }},
+		{"matching output", func(tx *Transaction){ tx.Vout[1].Value++ }},
+		{"other input's sequence", func(tx *Transaction){ tx.Vin[0].Sequence = 0 }},
+		{"added input", func(tx *Transaction){ tx.Vin = append(tx.Vin, TXInput{[]byte{3}, 0, nil, SequenceFinal}) }},
+		{"added output", func(tx *Transaction){ tx.Vout = append(tx.Vout, TXOutput{1, []byte{3}}) }},
+	}
+	// whether input 1's signature commits to each change, in order
+	tests := []struct{
+		hashType 	SigHashType
+		commits 	[]bool
+	}{
+		{SigHashAll, []bool{true, true, true, true, true}},
+		{SigHashNone, []bool{false, false, false, true, false}},
+		{SigHashSingle, []bool{false, true, false, true, false}},
+		{SigHashAll | SigHashAnyoneCanPay, []bool{true, true, false, false, true}},
+		{SigHashNone | SigHashAnyoneCanPay, []bool{false, false, false, false, false}},
+	}
+	for _,test := range tests{
+		want, err := base().SignatureHash(1, prev, test.hashType)
+		if err != nil{
+			t.Fatal(err)
+		}
+		for i, c := range changes{
+			tx := base()
+			c.change(tx)
+			got, err := tx.SignatureHash(1, prev, test.hashType)
+			if err != nil{
+				t.Fatal(err)
+			}
+			if committed := !bytes.Equal(got, want); committed != test.commits[i]{
+				t.Errorf("hash type %x, %s: committed %v", test.hashType, c.name, committed)
+			}
+		}
+	}
+	if _, err := base().SignatureHash(0, prev, 0x04); !errors.Is(err, ErrBadSigHashType){
+		t.Error("unknown hash type accepted", err)
+	}
+	single := base()
+	single.Vout = single.Vout[:1]
+	if _, err := single.SignatureHash(1, prev, SigHashSingle); !errors.Is(err, ErrBadSigHashType){
+		t.Error("SINGLE without a matching output accepted", err)
+	}
+}
+
+func TestSigHashNoneSpend(t *testing.T){
+	wallet := NewWallet()
+	tx, prev := spendOf(NewP2PKHScript(HashPubKey(wallet.PublicKey)))
+	if err := tx.SignInput(0, wallet.PrivateKey, prev, SigHashNone); err != nil{
+		t.Fatal(err)
+	}
+	// whoever holds the transaction may send the coins anywhere
+	tx.Vout[0] = TXOutput{9, []byte{2}}
+	if err := VerifyScript(tx, 0, prev); err != nil{
+		t.Fatal(err)
+	}
+	if err := tx.SignInput(0, wallet.PrivateKey, prev, SigHashAll); err != nil{
+		t.Fatal(err)
+	}
+	tx.Vout[0].Value--
+	if err := VerifyScript(tx, 0, prev); !errors.Is(err, ErrScriptFailed){
+		t.Fatal("changed output accepted", err)
+	}
+}
@@ -0,0 +1,73 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// Signatures are DER-encoded (r, s) pairs with s in the lower half of the
+// curve order, and public keys are SEC1-compressed points. Both have
+// exactly one valid encoding, so neither can be altered in transit.
+
+var (
+	ErrBadSignature = errors.New("malformed signature")
+	ErrHighS = errors.New("signature s value is not in the lower half of the curve order")
+	ErrBadPubKey = errors.New("malformed public key")
+)
+
+const compressedPubKeyLen = 33
+
+type ecdsaSignature struct{
+	R, S *big.Int
+}
+
+// encodeSignature returns the DER encoding of (r, s), replacing s by
+// N - s when it is in the upper half of the order
+func encodeSignature(r, s *big.Int) ([]byte, error){
+	halfOrder := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+	if s.Cmp(halfOrder) > 0{
+		s = new(big.Int).Sub(elliptic.P256().Params().N, s)
+	}
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+// parseSignature only accepts the exact bytes encodeSignature produces
+func parseSignature(der []byte) (*big.Int, *big.Int, error){
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) != 0{
+		return nil, nil, ErrBadSignature
+	}
+	canonical, err := asn1.Marshal(sig)
+	if err != nil || !bytes.Equal(canonical, der){
+		return nil, nil, ErrBadSignature
+	}
+	params := elliptic.P256().Params()
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.Cmp(params.N) >= 0{
+		return nil, nil, ErrBadSignature
+	}
+	if sig.S.Cmp(new(big.Int).Rsh(params.N, 1)) > 0{
+		return nil, nil, ErrHighS
+	}
+	return sig.R, sig.S, nil
+}
+
+func encodePubKey(pub *ecdsa.PublicKey) []byte{
+	return elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)
+}
+
+func parsePubKey(data []byte) (*ecdsa.PublicKey, error){
+	if len(data) != compressedPubKeyLen || (data[0] != 0x02 && data[0] != 0x03){
+		return nil, ErrBadPubKey
+	}
+	curve := elliptic.P256()
+	x, y := elliptic.UnmarshalCompressed(curve, data)
+	if x == nil{
+		return nil, ErrBadPubKey
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
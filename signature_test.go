@@ -0,0 +1,91 @@
+package blockchain_practice
+
+import (
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestSignatureEncoding(t *testing.T){
+	n := elliptic.P256().Params().N
+	r, high := big.NewInt(12345), new(big.Int).Sub(n, big.NewInt(2))
+	der, err := encodeSignature(r, high)
+	if err != nil{
+		t.Fatal(err)
+	}
+	gotR, gotS, err := parseSignature(der)
+	if err != nil || gotR.Cmp(r) != 0 || gotS.Cmp(big.NewInt(2)) != 0{
+		t.Fatal("s not moved to the lower half", gotS, err)
+	}
+	highDER, _ := asn1.Marshal(ecdsaSignature{r, high})
+	// a zero byte in front of an integer does not change its value
+	padded := append([]byte{0x30, der[1] + 1, 0x02, der[3] + 1, 0}, der[4:]...)
+	tests := []struct{
+		name 	string
+		der 		[]byte
+		err 		error
+	}{
+		{"high s", highDER, ErrHighS},
+		{"padded r", padded, ErrBadSignature},
+		{"trailing byte", append(append([]byte{}, der...), 0), ErrBadSignature},
+		{"truncated", der[:len(der)-1], ErrBadSignature},
+		{"zero r", mustMarshal(t, ecdsaSignature{big.NewInt(0), big.NewInt(2)}), ErrBadSignature},
+		{"r above the order", mustMarshal(t, ecdsaSignature{n, big.NewInt(2)}), ErrBadSignature},
+	}
+	for _,test := range tests{
+		if _, _, err := parseSignature(test.der); !errors.Is(err, test.err){
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, sig ecdsaSignature) []byte{
+	der, err := asn1.Marshal(sig)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestSignaturesAreLowS(t *testing.T){
+	wallet := NewWallet()
+	tx, prev := spendOf(NewP2PKHScript(HashPubKey(wallet.PublicKey)))
+	for i := 0; i < 50; i++{
+		tx.Vout[0].Value = i
+		sig, err := tx.CreateSignature(0, wallet.PrivateKey, prev, SigHashAll)
+		if err != nil{
+			t.Fatal(err)
+		}
+		if _, _, err := parseSignature(sig[:len(sig)-1]); err != nil{
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPubKeyEncoding(t *testing.T){
+	wallet := NewWallet()
+	key := wallet.PrivateKey.PublicKey
+	data := encodePubKey(&key)
+	if len(data) != compressedPubKeyLen || string(data) != string(wallet.PublicKey){
+		t.Fatalf("wallet key %x is not the compressed %x", wallet.PublicKey, data)
+	}
+	got, err := parsePubKey(data)
+	if err != nil || got.X.Cmp(key.X) != 0 || got.Y.Cmp(key.Y) != 0{
+		t.Fatal("round trip", err)
+	}
+	offCurve := append([]byte{}, data...)
+	for offCurve[len(offCurve)-1]++; ; offCurve[len(offCurve)-1]++{
+		if x, _ := elliptic.UnmarshalCompressed(elliptic.P256(), offCurve); x == nil{
+			break
+		}
+	}
+	badPrefix := append([]byte{0x04}, data[1:]...)
+	uncompressed := elliptic.Marshal(key.Curve, key.X, key.Y)
+	for name, bad := range map[string][]byte{"uncompressed": uncompressed, "bad prefix": badPrefix, "off the curve": offCurve, "short": data[1:]}{
+		if _, err := parsePubKey(bad); !errors.Is(err, ErrBadPubKey){
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+// A UTXO snapshot lets a new node start at a recent block instead of
+// replaying the whole chain. It holds the headers from genesis to the
+// snapshot block, so their proof of work can be checked, the snapshot block
+// itself, and the UTXO set at that block with its MuHash. Loading one
+// records the snapshot block and hash in snapshotBucket; ValidateSnapshot
+// later replays the historical blocks in a separate database and checks
+// that they produce the same hash.
+const (
+	snapshotVersion = 1
+	snapshotBucket = "snapshot"
+)
+
+var (
+	ErrBadSnapshot = errors.New("bad UTXO snapshot")
+	ErrBlockUnavailable = errors.New("no peer sent the block")
+)
+
+// snapshotBlockTimeout is how long ValidateSnapshot waits for a historical
+// block before giving up until the node restarts
+var snapshotBlockTimeout = 30 * time.Minute
+
+type snapshotEntry struct{
+	key 		[]byte
+	value 	[]byte
+}
+
+type UTXOSnapshot struct{
+	Headers 		[]*BlockHeader
+	Base 			*Block
+	UTXOHash 	[]byte
+	entries 		[]snapshotEntry
+}
+
+func (s *UTXOSnapshot) Height() int{
+	return s.Base.Height
+}
+
+func (s *UTXOSnapshot) Count() int{
+	return len(s.entries)
+}
+
+func (s *UTXOSnapshot) Serialize() []byte{
+	e := &encoder{}
+	e.writeUint32(snapshotVersion)
+	e.writeVarInt(uint64(len(s.Headers)))
+	for _,h := range s.Headers{
+		e.buf.Write(h.Serialize())
+	}
+	e.writeVarBytes(s.Base.Serialize())
+	e.writeVarBytes(s.UTXOHash)
+	e.writeVarInt(uint64(len(s.entries)))
+	for _,entry := range s.entries{
+		e.writeVarBytes(entry.key)
+		e.writeVarBytes(entry.value)
+	}
+	return e.Bytes()
+}
+
+func DeserializeSnapshot(data []byte) (*UTXOSnapshot, error){
+	s := &UTXOSnapshot{}
+	d := &decoder{data: data}
+	if version := d.readUint32(); version != snapshotVersion{
+		d.fail("unknown snapshot version %d", version)
+	}
+	for i, n := 0, d.readCount(headerLen); i < n; i++{
+		h, err := DeserializeHeader(d.next(headerLen))
+		if d.err != nil{
+			break
+		}
+		if err != nil{
+			return nil, err
+		}
+		s.Headers = append(s.Headers, h)
+	}
+	base, err := DeserializeBlock(d.readVarBytes())
+	if d.err == nil && err != nil{
+		return nil, err
+	}
+	s.Base = base
+	s.UTXOHash = d.readVarBytes()
+	for i, n := 0, d.readCount(2); i < n; i++{
+		s.entries = append(s.entries, snapshotEntry{d.readVarBytes(), d.readVarBytes()})
+	}
+	err = d.finish()
+	if err != nil{
+		return nil, err
+	}
+	if len(s.Headers) == 0{
+		return nil, fmt.Errorf("%w: no headers", ErrBadSnapshot)
+	}
+	return s, nil
+}
+
+// DumpUTXO returns a snapshot of the UTXO set at the current tip
+func (bc *Blockchain) DumpUTXO() (*UTXOSnapshot, error){
+	s := &UTXOSnapshot{}
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(blocksBucket))
+		tip := b.Get([]byte("l"))
+		base, err := DeserializeBlock(b.Get(tip))
+		if err != nil{
+			return err
+		}
+		s.Base = base
+		for hash := tip; len(hash) > 0;{
+			header := getHeader(tx, hash)
+			s.Headers = append([]*BlockHeader{header}, s.Headers...)
+			hash = header.PreBlockHash
+		}
+		h, err := loadUTXOHash(tx)
+		if err != nil{
+			return err
+		}
+		s.UTXOHash = h.Digest()
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
+		for k,v:=c.First();k!=nil;k,v=c.Next(){
+			s.entries = append(s.entries, snapshotEntry{append([]byte{}, k...), append([]byte{}, v...)})
+		}
+		return nil
+	})
+	if err != nil{
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadUTXO makes the snapshot's block the tip and its UTXO set the current
+// one. The chain must not have grown past its genesis block, which has to
+// be the snapshot's. Blocks between the two are left to ValidateSnapshot.
+func (bc *Blockchain) LoadUTXO(s *UTXOSnapshot) error{
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(blocksBucket))
+		genesis := b.Get([]byte("l"))
+		if getHeader(tx, genesis).Height != 0{
+			return fmt.Errorf("%w: the chain is past its genesis block", ErrBadSnapshot)
+		}
+		if !bytes.Equal(s.Headers[0].Hash(), genesis){
+			return fmt.Errorf("%w: genesis block %x, ours is %x", ErrBadSnapshot, s.Headers[0].Hash(), genesis)
+		}
+		for i, h := range s.Headers[1:]{
+			parent := s.Headers[i]
+			header := &Block{*h, nil, h.Hash()}
+			if !bytes.Equal(h.PreBlockHash, parent.Hash()) || h.Height != parent.Height+1{
+				return fmt.Errorf("%w: header %x does not follow %x", ErrBadSnapshot, header.Hash, parent.Hash())
+			}
+			err := checkProofOfWork(tx, parent, header)
+			if err != nil{
+				return fmt.Errorf("%w: %s", ErrBadSnapshot, err)
+			}
+			err = putHeader(tx, header)
+			if err != nil{
+				return err
+			}
+			_, err = putChainWork(tx, header)
+			if err != nil{
+				return err
+			}
+			err = setMainChain(tx, h.Height, header.Hash)
+			if err != nil{
+				return err
+			}
+		}
+		base := s.Base
+		if !bytes.Equal(base.Hash, s.Headers[len(s.Headers)-1].Hash()){
+			return fmt.Errorf("%w: block %x is not the last header", ErrBadSnapshot, base.Hash)
+		}
+		if !bytes.Equal(base.MerkleRoot, base.HashTransactions()){
+			return fmt.Errorf("%w: block %x does not match its merkle root", ErrBadSnapshot, base.Hash)
+		}
+		err := b.Put(base.Hash, base.Serialize())
+		if err != nil{
+			return err
+		}
+		err = loadUTXOEntries(tx, s)
+		if err != nil{
+			return err
+		}
+		// the index can only be rebuilt once every block is stored
+		err = tx.DeleteBucket([]byte(txIndexBucket))
+		if err != nil && err != bolt.ErrBucketNotFound{
+			return err
+		}
+		sb, err := tx.CreateBucketIfNotExists([]byte(snapshotBucket))
+		if err != nil{
+			return err
+		}
+		err = sb.Put([]byte("base"), base.Hash)
+		if err != nil{
+			return err
+		}
+		err = sb.Put([]byte("hash"), s.UTXOHash)
+		if err != nil{
+			return err
+		}
+		return b.Put([]byte("l"), base.Hash)
+	})
+	if err != nil{
+		return err
+	}
+	bc.tail = s.Base.Hash
+	return nil
+}
+
+// loadUTXOEntries replaces the UTXO set with the snapshot's, which has to
+// hash to the snapshot's UTXOHash
+func loadUTXOEntries(tx *bolt.Tx, s *UTXOSnapshot) error{
+	for _,name := range []string{utxoBucket, addrIndexBucket, utxoHashBucket, undoBucket, legacyUndoBucket}{
+		err := tx.DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound{
+			return err
+		}
+	}
+	b, err := tx.CreateBucket([]byte(utxoBucket))
+	if err != nil{
+		return err
+	}
+	ib, err := tx.CreateBucket([]byte(addrIndexBucket))
+	if err != nil{
+		return err
+	}
+	h := NewMuHash()
+	for _,e := range s.entries{
+		entry, err := DeserializeUTXOEntry(e.value)
+		if err != nil || len(e.key) != 36{
+			return fmt.Errorf("%w: entry %x", ErrBadSnapshot, e.key)
+		}
+		txid, index := splitOutpointKey(e.key)
+		err = b.Put(e.key, e.value)
+		if err != nil{
+			return err
+		}
+		err = indexOutput(ib, entry.Output.LockScript, txid, index)
+		if err != nil{
+			return err
+		}
+		h.Add(utxoHashElement(txid, index, entry))
+	}
+	if digest := h.Digest(); !bytes.Equal(digest, s.UTXOHash){
+		return fmt.Errorf("%w: entries hash to %x, not %x", ErrBadSnapshot, digest, s.UTXOHash)
+	}
+	return storeUTXOHash(tx, h)
+}
+
+// SnapshotPending reports whether the chain was started from a snapshot
+// that ValidateSnapshot has not finished checking
+func (bc *Blockchain) SnapshotPending() bool{
+	pending := false
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		sb := tx.Bucket([]byte(snapshotBucket))
+		pending = sb != nil && sb.Get([]byte("validated")) == nil && sb.Get([]byte("invalid")) == nil
+		return nil
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return pending
+}
+
+// SnapshotInvalid reports whether the chain was started from a snapshot
+// that failed validation, and why
+func (bc *Blockchain) SnapshotInvalid() (string, bool){
+	var reason []byte
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		if sb := tx.Bucket([]byte(snapshotBucket)); sb != nil{
+			reason = append([]byte{}, sb.Get([]byte("invalid"))...)
+		}
+		return nil
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return string(reason), len(reason) > 0
+}
+
+// ValidateSnapshot connects the blocks from genesis to the snapshot block
+// in a separate database, kept next to the chain's so a restart resumes
+// where it stopped, and compares the resulting UTXO set hash with the
+// snapshot's. Blocks that are not stored yet are requested with fetch
+// until they arrive, failing with ErrBlockUnavailable if one does not
+// within snapshotBlockTimeout. The outcome is recorded in snapshotBucket.
+func (bc *Blockchain) ValidateSnapshot(fetch func(hash []byte)) error{
+	var claimed []byte
+	var hashes [][]byte
+	var genesis *Block
+	err := bc.db.View(func(tx *bolt.Tx)error{
+		sb := tx.Bucket([]byte(snapshotBucket))
+		claimed = append([]byte{}, sb.Get([]byte("hash"))...)
+		hash := append([]byte{}, sb.Get([]byte("base"))...)
+		for{
+			header := getHeader(tx, hash)
+			if header.Height == 0{
+				var err error
+				genesis, err = DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(hash))
+				return err
+			}
+			hashes = append([][]byte{hash}, hashes...)
+			hash = header.PreBlockHash
+		}
+	})
+	if err != nil{
+		return err
+	}
+	path := bc.db.Path() + ".snapshot"
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil{
+		return err
+	}
+	defer db.Close()
+	replay := &Blockchain{nil, db}
+	err = db.Update(func(tx *bolt.Tx)error{
+		if b := tx.Bucket([]byte(blocksBucket)); b != nil{
+			replay.tail = append([]byte{}, b.Get([]byte("l"))...)
+			return nil
+		}
+		replay.tail = genesis.Hash
+		err := storeGenesis(tx, genesis)
+		if err != nil{
+			return err
+		}
+		return reindexUTXO(tx, genesis.Hash)
+	})
+	if err != nil{
+		return err
+	}
+	for _,hash := range hashes[replay.GetBestHeight():]{
+		block, err := bc.waitForBlock(hash, fetch)
+		if err != nil{
+			return err
+		}
+		_, err = replay.AddBlock(block)
+		if err != nil{
+			return bc.finishSnapshot(fmt.Errorf("%w: historical block %x: %s", ErrBadSnapshot, hash, err))
+		}
+	}
+	if got := (UTXOSet{replay}).Hash().Hash; !bytes.Equal(got, claimed){
+		return bc.finishSnapshot(fmt.Errorf("%w: the chain gives UTXO hash %x, the snapshot %x", ErrBadSnapshot, got, claimed))
+	}
+	db.Close()
+	err = os.Remove(path)
+	if err != nil{
+		return err
+	}
+	return bc.finishSnapshot(nil)
+}
+
+// waitForBlock returns the stored block hash, asking fetch for it every
+// ten seconds until it is there or snapshotBlockTimeout has passed
+func (bc *Blockchain) waitForBlock(hash []byte, fetch func(hash []byte)) (*Block, error){
+	deadline := time.Now().Add(snapshotBlockTimeout)
+	for tries := 0;; tries++{
+		block, err := bc.GetBlock(hash)
+		if err == nil{
+			return &block, nil
+		}
+		if time.Now().After(deadline){
+			return nil, fmt.Errorf("%w: %x", ErrBlockUnavailable, hash)
+		}
+		if tries%20 == 0{
+			fetch(hash)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// finishSnapshot records whether validation failed with result or passed
+func (bc *Blockchain) finishSnapshot(result error) error{
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		sb := tx.Bucket([]byte(snapshotBucket))
+		if result != nil{
+			return sb.Put([]byte("invalid"), []byte(result.Error()))
+		}
+		return sb.Put([]byte("validated"), []byte{1})
+	})
+	if err != nil{
+		return err
+	}
+	return result
+}
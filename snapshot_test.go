@@ -0,0 +1,147 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+// sameGenesis returns an empty chain with the genesis block of src
+func sameGenesis(t *testing.T, src *Blockchain) *Blockchain{
+	var genesis *Block
+	for it := src.Iterator(); genesis == nil;{
+		if block := it.Next(); len(block.PreBlockHash) == 0{
+			genesis = block
+		}
+	}
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "blockchain.db"), 0600, nil)
+	if err != nil{
+		t.Fatal(err)
+	}
+	t.Cleanup(func(){ db.Close() })
+	err = db.Update(func(tx *bolt.Tx)error{
+		err := storeGenesis(tx, genesis)
+		if err != nil{
+			return err
+		}
+		return reindexUTXO(tx, genesis.Hash)
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	return &Blockchain{genesis.Hash, db}
+}
+
+func TestLoadSnapshot(t *testing.T){
+	src, wallet, _ := spendingChain(t)
+	dumped, err := src.DumpUTXO()
+	if err != nil{
+		t.Fatal(err)
+	}
+	snapshot, err := DeserializeSnapshot(dumped.Serialize())
+	if err != nil{
+		t.Fatal(err)
+	}
+	// entries that do not give the snapshot's hash are refused
+	tampered, _ := DeserializeSnapshot(dumped.Serialize())
+	entry := tampered.entries[0].value
+	tampered.entries[0].value = append(append([]byte{}, entry[:len(entry)-1]...), entry[len(entry)-1]^1)
+	if err := sameGenesis(t, src).LoadUTXO(tampered); !errors.Is(err, ErrBadSnapshot){
+		t.Fatal("tampered snapshot loaded", err)
+	}
+	if err := src.LoadUTXO(snapshot); !errors.Is(err, ErrBadSnapshot){
+		t.Fatal("snapshot loaded over a chain", err)
+	}
+	bc := sameGenesis(t, src)
+	if err := bc.LoadUTXO(snapshot); err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(UTXOSet{bc}.Hash().Hash, UTXOSet{src}.Hash().Hash) || bc.GetBestHeight() != src.GetBestHeight(){
+		t.Fatal("loaded state differs")
+	}
+	if !bc.SnapshotPending(){
+		t.Fatal("snapshot not pending validation")
+	}
+	// the node can build on it right away
+	address := string(wallet.GetAddress())
+	next := mineOn(bc, tipBlock(t, bc), address)
+	if _, err := bc.AddBlock(next); err != nil{
+		t.Fatal(err)
+	}
+	fetch := func(hash []byte){
+		block, err := src.GetBlock(hash)
+		if err != nil{
+			t.Fatal(err)
+		}
+		if _, err := bc.AddBlock(&block); err != nil{
+			t.Fatal(err)
+		}
+	}
+	if err := bc.ValidateSnapshot(fetch); err != nil{
+		t.Fatal(err)
+	}
+	if bc.SnapshotPending(){
+		t.Fatal("validated snapshot still pending")
+	}
+	if _, err := os.Stat(bc.db.Path() + ".snapshot"); !os.IsNotExist(err){
+		t.Fatal("replay database left behind", err)
+	}
+}
+
+func TestValidateSnapshotRejectsWrongSet(t *testing.T){
+	src, _, _ := spendingChain(t)
+	snapshot, err := src.DumpUTXO()
+	if err != nil{
+		t.Fatal(err)
+	}
+	// a set consistent with its own hash, but not the chain's
+	snapshot.entries = snapshot.entries[1:]
+	h := NewMuHash()
+	for _,e := range snapshot.entries{
+		h.Add(append(append([]byte{}, e.key...), e.value...))
+	}
+	snapshot.UTXOHash = h.Digest()
+	bc := sameGenesis(t, src)
+	if err := bc.LoadUTXO(snapshot); err != nil{
+		t.Fatal(err)
+	}
+	err = bc.ValidateSnapshot(func(hash []byte){
+		block, _ := src.GetBlock(hash)
+		bc.AddBlock(&block)
+	})
+	if !errors.Is(err, ErrBadSnapshot){
+		t.Fatal("wrong UTXO set validated", err)
+	}
+	if reason, invalid := bc.SnapshotInvalid(); !invalid || reason == ""{
+		t.Fatal("failure not recorded")
+	}
+}
+
+func TestValidateSnapshotGivesUp(t *testing.T){
+	old := snapshotBlockTimeout
+	snapshotBlockTimeout = time.Millisecond
+	defer func(){ snapshotBlockTimeout = old }()
+	src, wallet := newTestChain(t)
+	extend(t, src, 3, string(wallet.GetAddress()))
+	snapshot, err := src.DumpUTXO()
+	if err != nil{
+		t.Fatal(err)
+	}
+	bc := sameGenesis(t, src)
+	if err := bc.LoadUTXO(snapshot); err != nil{
+		t.Fatal(err)
+	}
+	fetches := 0
+	err = bc.ValidateSnapshot(func(hash []byte){ fetches++ })
+	if !errors.Is(err, ErrBlockUnavailable) || fetches != 1{
+		t.Fatal(err, fetches)
+	}
+	// nobody sending a block says nothing about the snapshot
+	if _, invalid := bc.SnapshotInvalid(); invalid || !bc.SnapshotPending(){
+		t.Fatal("snapshot judged without its blocks")
+	}
+}
@@ -0,0 +1,60 @@
+package blockchain_practice
+
+// The coinbase of the block at height may create at most
+// BlockSubsidy(height) new coins. The subsidy starts at initialSubsidy and
+// halves every HalvingInterval blocks, so the supply converges on
+// MaxSupply().
+const initialSubsidy = 10
+
+// MaxMoney bounds every amount: an output, the outputs or inputs of a
+// transaction and the fees of a block. It is far above MaxSupply() and
+// keeps sums of checked amounts from overflowing.
+const MaxMoney = 1 << 50
+
+func moneyRange(value int) bool{
+	return value >= 0 && value <= MaxMoney
+}
+
+// CoinbaseMaturity is how many blocks a coinbase's outputs have to wait
+// before they can be spent, so a reorg cannot take away coins that were
+// already passed on
+var CoinbaseMaturity = 10
+
+// HalvingInterval is the number of blocks between subsidy halvings. Every
+// node of a network has to agree on it.
+var HalvingInterval = 210
+
+func BlockSubsidy(height int) int{
+	halvings := height / HalvingInterval
+	if halvings >= 63{
+		return 0
+	}
+	return initialSubsidy >> uint(halvings)
+}
+
+// ScheduledSupply returns the coins issued by the blocks up to and
+// including height if every coinbase claims its full subsidy
+func ScheduledSupply(height int) int{
+	supply := 0
+	for start:=0;start<=height;start+=HalvingInterval{
+		s := BlockSubsidy(start)
+		if s == 0{
+			break
+		}
+		blocks := HalvingInterval
+		if height-start+1 < blocks{
+			blocks = height-start+1
+		}
+		supply += s*blocks
+	}
+	return supply
+}
+
+// MaxSupply is the most coins there will ever be
+func MaxSupply() int{
+	supply := 0
+	for halvings:=0;BlockSubsidy(halvings*HalvingInterval) > 0;halvings++{
+		supply += BlockSubsidy(halvings*HalvingInterval) * HalvingInterval
+	}
+	return supply
+}
@@ -0,0 +1,46 @@
+package blockchain_practice
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSubsidySchedule(t *testing.T){
+	defer func(interval int){ HalvingInterval = interval }(HalvingInterval)
+	HalvingInterval = 3
+	subsidies := []int{10, 10, 10, 5, 5, 5, 2, 2, 2, 1, 1, 1, 0, 0}
+	supply := 0
+	for height, want := range subsidies{
+		if got := BlockSubsidy(height); got != want{
+			t.Errorf("subsidy at %d: got %d, want %d", height, got, want)
+		}
+		supply += want
+		if got := ScheduledSupply(height); got != supply{
+			t.Errorf("supply at %d: got %d, want %d", height, got, supply)
+		}
+	}
+	if MaxSupply() != supply{
+		t.Errorf("max supply %d, want %d", MaxSupply(), supply)
+	}
+	HalvingInterval = 1
+	if BlockSubsidy(63) != 0 || BlockSubsidy(1 << 20) != 0{
+		t.Error("subsidy after every halving")
+	}
+}
+
+func TestCoinbaseAfterHalving(t *testing.T){
+	defer func(interval int){ HalvingInterval = interval }(HalvingInterval)
+	HalvingInterval = 3
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	tip := extend(t, bc, 4, address)
+	if supply := (UTXOSet{bc}).TotalSupply(); supply != ScheduledSupply(4){
+		t.Fatalf("supply %d, want %d", supply, ScheduledSupply(4))
+	}
+	// a coinbase claiming the subsidy from before the halving
+	coinbase := NewCoinbaseTX(address, "", 2, 0)
+	block := NewBlockAt([]*Transaction{coinbase}, tip.Hash, tip.Height+1, bc.CalcNextBits(tip.Hash), tip.Timestamp+targetBlockTime)
+	if _, err := bc.AddBlock(block); !errors.Is(err, ErrOversizedCoinbase){
+		t.Fatal("coinbase above the subsidy accepted", err)
+	}
+}
@@ -0,0 +1,243 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Blocks are downloaded headers first. A peer with more work is asked for
+// the headers following our block locator, which are checked and stored on
+// their own; the bodies of the best header chain are then fetched in
+// parallel from the peers whose headers reached them, since only those are
+// known to have them, and a peer answering notfound is not asked for that
+// chain again until it sends more headers. Each peer has at most
+// maxBlocksInFlight requests outstanding, only blocks within downloadWindow
+// of the first missing one are requested so the orphan pool can hold those
+// arriving early, and a peer that does not deliver within blockTimeout is
+// dropped and its requests handed to the others.
+const (
+	maxBlocksInFlight = 16
+	downloadWindow = 64
+	blockTimeout = 20 * time.Second
+	syncInterval = 2 * time.Second
+)
+
+type blockRequest struct{
+	hash 		[]byte
+	peer 		*peer
+	sent 		time.Time
+}
+
+// syncManager tracks the blocks still to download, parent first, which
+// peer each was requested from, and the last header each peer sent
+type syncManager struct{
+	mu 			sync.Mutex
+	pm 			*PeerManager
+	want 		[]*blockRequest
+	tips 		map[*peer][]byte
+	best 		[]byte
+	bestWork 	*big.Int
+}
+
+func newSyncManager(pm *PeerManager) *syncManager{
+	return &syncManager{pm: pm, tips: make(map[*peer][]byte)}
+}
+
+// announced records that p sent the headers up to hash, so it has the
+// blocks of the chain ending there
+func (s *syncManager) announced(p *peer, hash []byte){
+	s.mu.Lock()
+	s.tips[p] = hash
+	s.mu.Unlock()
+}
+
+// notFound takes back the request for hash from p, which does not have it,
+// and stops asking p for blocks until it sends headers again
+func (s *syncManager) notFound(p *peer, hash []byte){
+	s.mu.Lock()
+	delete(s.tips, p)
+	for _,r := range s.want{
+		if r.peer == p && bytes.Equal(r.hash, hash){
+			r.peer = nil
+		}
+	}
+	s.mu.Unlock()
+	s.request()
+}
+
+// syncTo sets the chain ending at header best, with chain work work, as
+// the one to download, unless the one being downloaded has as much work.
+// Requests already sent for blocks on it are kept.
+func (s *syncManager) syncTo(best []byte, work *big.Int){
+	s.mu.Lock()
+	if s.best != nil && work.Cmp(s.bestWork) <= 0{
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	missing := s.pm.bc.MissingBlocks(best)
+	s.mu.Lock()
+	sent := make(map[string]*blockRequest)
+	for _,r := range s.want{
+		sent[string(r.hash)] = r
+	}
+	s.want = nil
+	for _,header := range missing{
+		hash := header.Hash()
+		r := sent[string(hash)]
+		if r == nil{
+			r = &blockRequest{hash: hash}
+		}
+		s.want = append(s.want, r)
+	}
+	s.best, s.bestWork = best, work
+	if len(s.want) == 0{
+		s.best, s.bestWork = nil, nil
+	}
+	s.mu.Unlock()
+	s.request()
+}
+
+// wanted reports whether hash is waiting to be downloaded
+func (s *syncManager) wanted(hash []byte) bool{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _,r := range s.want{
+		if bytes.Equal(r.hash, hash){
+			return true
+		}
+	}
+	return false
+}
+
+// gotBlock records that hash arrived and requests more blocks
+func (s *syncManager) gotBlock(hash []byte){
+	s.mu.Lock()
+	for i, r := range s.want{
+		if bytes.Equal(r.hash, hash){
+			s.want = append(s.want[:i], s.want[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	s.request()
+}
+
+// forget stops downloading hash, which failed validation, and the blocks
+// after it
+func (s *syncManager) forget(hash []byte){
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.want{
+		if bytes.Equal(r.hash, hash){
+			s.want = s.want[:i]
+			s.best, s.bestWork = nil, nil
+			return
+		}
+	}
+}
+
+// request asks for the blocks in the download window that are not in
+// flight, each from the peer with the fewest requests outstanding among
+// those that have it
+func (s *syncManager) request(){
+	type send struct{
+		p 		*peer
+		hash 	[]byte
+	}
+	peers := s.pm.syncPeers()
+	var sends []send
+	s.mu.Lock()
+	inFlight := make(map[*peer]int)
+	index := make(map[string]int)
+	for i, r := range s.want{
+		if r.peer != nil{
+			inFlight[r.peer]++
+		}
+		index[string(r.hash)] = i
+	}
+	// a peer has every block up to the one its headers ended at
+	reach := make(map[*peer]int)
+	for _,p := range peers{
+		if i, ok := index[string(s.tips[p])]; ok{
+			reach[p] = i
+		}
+	}
+	now := time.Now()
+	for i, r := range s.want{
+		if i >= downloadWindow{
+			break
+		}
+		if r.peer != nil{
+			continue
+		}
+		var best *peer
+		for p, last := range reach{
+			if last >= i && inFlight[p] < maxBlocksInFlight && (best == nil || inFlight[p] < inFlight[best]){
+				best = p
+			}
+		}
+		if best == nil{
+			continue
+		}
+		r.peer, r.sent = best, now
+		inFlight[best]++
+		sends = append(sends, send{best, r.hash})
+	}
+	s.mu.Unlock()
+	for _,send := range sends{
+		send.p.queue("getdata", gobEncode(getdata{nodeAddress, "block", send.hash}))
+	}
+}
+
+// Run periodically takes back the requests of peers that went away or
+// stalled, dropping the stalled ones, and hands them to other peers
+func (s *syncManager) Run(){
+	for{
+		s.maintain(time.Now())
+		time.Sleep(syncInterval)
+	}
+}
+
+func (s *syncManager) maintain(now time.Time){
+	var stalled []*peer
+	dropped := make(map[*peer]bool)
+	s.mu.Lock()
+	for p := range s.tips{
+		if p.closed(){
+			delete(s.tips, p)
+		}
+	}
+	for _,r := range s.want{
+		if r.peer == nil{
+			continue
+		}
+		closed := r.peer.closed()
+		if !closed && now.Sub(r.sent) <= blockTimeout{
+			continue
+		}
+		if !closed && !dropped[r.peer]{
+			stalled = append(stalled, r.peer)
+			dropped[r.peer] = true
+		}
+		r.peer = nil
+	}
+	// blocks held as orphans can be evicted before their parent arrives,
+	// look again for anything still missing once the list has drained
+	best, work := s.best, s.bestWork
+	restart := len(s.want) == 0 && best != nil
+	if restart{
+		s.best, s.bestWork = nil, nil
+	}
+	s.mu.Unlock()
+	for _,p := range stalled{
+		s.pm.drop(p, "block download timed out")
+	}
+	if restart{
+		s.syncTo(best, work)
+		return
+	}
+	s.request()
+}
@@ -0,0 +1,140 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// useNode points the node-wide globals at pm until the test ends
+func useNode(t *testing.T, pm *PeerManager, address string){
+	oldAddress, oldManager, oldSync := nodeAddress, peerManager, blockSync
+	nodeAddress, peerManager, blockSync = address, pm, newSyncManager(pm)
+	t.Cleanup(func(){ nodeAddress, peerManager, blockSync = oldAddress, oldManager, oldSync })
+}
+
+// closePeers closes every connection of pm when the test ends, before the
+// chain's database is closed
+func closePeers(t *testing.T, pm *PeerManager){
+	t.Cleanup(func(){
+		pm.mu.Lock()
+		var peers []*peer
+		for p := range pm.peers{
+			peers = append(peers, p)
+		}
+		pm.mu.Unlock()
+		for _,p := range peers{
+			p.close()
+		}
+	})
+}
+
+// waitFor polls done for up to ten seconds
+func waitFor(done func() bool) bool{
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond){
+		if done(){
+			return true
+		}
+	}
+	return done()
+}
+
+func TestHeadersFirstSync(t *testing.T){
+	src, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	extend(t, src, 30, address)
+	bc := sameGenesis(t, src)
+	serving, syncing := NewPeerManager(src, nil), NewPeerManager(bc, nil)
+	closePeers(t, serving)
+	closePeers(t, syncing)
+	useNode(t, syncing, "localhost:0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func(){
+		for{
+			conn, err := ln.Accept()
+			if err != nil{
+				return
+			}
+			serving.Accept(conn)
+		}
+	}()
+	if _, err := syncing.Connect(ln.Addr().String()); err != nil{
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool{ return bc.GetBestHeight() == 30 }){
+		t.Fatal("synced to height", bc.GetBestHeight())
+	}
+	if !bytes.Equal(bc.tail, src.tail) || !bytes.Equal(UTXOSet{bc}.Hash().Hash, UTXOSet{src}.Hash().Hash){
+		t.Fatal("synced chain differs")
+	}
+	// a new block is fetched through its announcement
+	next := extend(t, src, 1, address)
+	for _,p := range serving.syncPeers(){
+		p.queue("inv", gobEncode(inv{"", "block", [][]byte{next.Hash}}))
+	}
+	if !waitFor(func() bool{ return bytes.Equal(bc.tail, next.Hash) }){
+		t.Fatal("announced block not fetched")
+	}
+}
+
+// syncPeer returns an outbound peer of pm that finished the handshake,
+// with whatever is sent to it discarded
+func syncPeer(t *testing.T, pm *PeerManager, addr string) *peer{
+	conn, other := net.Pipe()
+	t.Cleanup(func(){ other.Close() })
+	p := newPeer(pm, conn, addr, false)
+	p.versionReceived, p.verackReceived = true, true
+	pm.mu.Lock()
+	pm.peers[p] = true
+	pm.byAddr[addr] = p
+	pm.mu.Unlock()
+	return p
+}
+
+func TestBlockRequests(t *testing.T){
+	bc, _ := newTestChain(t)
+	pm := NewPeerManager(bc, nil)
+	useNode(t, pm, "localhost:0")
+	s := blockSync
+	p, q := syncPeer(t, pm, "p:1"), syncPeer(t, pm, "q:1")
+	s.want = []*blockRequest{{hash: []byte{1}}, {hash: []byte{2}}}
+	requestedFrom := func() (*peer, *peer){
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.want[0].peer, s.want[1].peer
+	}
+	// only a peer whose headers reached a block is asked for it
+	s.request()
+	if first, second := requestedFrom(); first != nil || second != nil{
+		t.Fatal("requested from peers without the blocks")
+	}
+	s.announced(p, []byte{1})
+	s.request()
+	if first, second := requestedFrom(); first != p || second != nil{
+		t.Fatal("requests", first, second)
+	}
+	s.announced(q, []byte{2})
+	s.request()
+	if first, second := requestedFrom(); first != p || second != q{
+		t.Fatal("requests", first, second)
+	}
+	// notfound hands the block to a peer that may have it
+	s.notFound(p, []byte{1})
+	s.request()
+	if first, _ := requestedFrom(); first != q{
+		t.Fatal("block not asked from the other peer", first)
+	}
+	// a peer that does not deliver is dropped and its requests taken back
+	s.maintain(time.Now().Add(blockTimeout + time.Second))
+	if !q.closed() || p.closed(){
+		t.Fatal("stalled peer kept")
+	}
+	if first, second := requestedFrom(); first != nil || second != nil{
+		t.Fatal("requests of a dropped peer kept", first, second)
+	}
+}
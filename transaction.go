@@ -2,7 +2,6 @@ package blockchain_practice
 
 import (
 	"fmt"
-	"encoding/gob"
 	"crypto/sha256"
 	"log"
 	"bytes"
@@ -10,30 +9,25 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"strings"
-	"crypto/elliptic"
-	"math/big"
 )
 
 type Transaction struct{
 	HashID 		[]byte
 	Vin		 		[]TXInput
 	Vout 			[]TXOutput
+	LockTime 	uint32
 }
 
 type TXOutput struct{
 	Value 				int
-	PubKeyHash 	[]byte
-}
-
-type TXOutputs struct{
-	Outputs []TXOutput
+	LockScript 	[]byte
 }
 
 type TXInput struct{
 	TxID 				[]byte
 	PreOutIndex	int
-	Signature 		[]byte
-	PubKey 			[]byte
+	UnlockScript	[]byte
+	Sequence 		uint32
 }
 
 func (tx Transaction) IsCoinbase() bool{
@@ -41,68 +35,115 @@ func (tx Transaction) IsCoinbase() bool{
 }
 
 func (tx Transaction) Serialize() []byte{
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(tx)
-	if err != nil{
-		log.Panic(err)
+	e := &encoder{}
+	tx.encode(e)
+	return e.Bytes()
+}
+
+func (tx Transaction) encode(e *encoder){
+	e.writeUint32(txFormatVersion)
+	e.writeVarInt(uint64(len(tx.Vin)))
+	for _,in := range tx.Vin{
+		in.encode(e)
+	}
+	e.writeVarInt(uint64(len(tx.Vout)))
+	for _,out := range tx.Vout{
+		out.encode(e)
 	}
-	return buf.Bytes()
+	e.writeUint32(tx.LockTime)
 }
 
+func decodeTransaction(d *decoder) Transaction{
+	var tx Transaction
+	// format 1 ids hash a layout without lock times and sequences, so
+	// those transactions cannot be read into the current one
+	if version := d.readUint32(); version == 1 && d.err == nil{
+		d.err = ErrOldTxFormat
+		return tx
+	}else if version != txFormatVersion{
+		d.fail("unknown transaction version %d", version)
+		return tx
+	}
+	for i, n := 0, d.readCount(10); i < n; i++{
+		tx.Vin = append(tx.Vin, decodeInput(d))
+	}
+	for i, n := 0, d.readCount(9); i < n; i++{
+		tx.Vout = append(tx.Vout, decodeOutput(d))
+	}
+	tx.LockTime = d.readUint32()
+	if d.err == nil{
+		tx.HashID = tx.Hash()
+	}
+	return tx
+}
+
+// Hash returns the transaction id. It is taken over the unsigned
+// transaction, so filling in the unlock scripts does not change it. A
+// coinbase keeps its unlock script, which holds its extra data.
 func (tx *Transaction) Hash() []byte{
 	var hash [32]byte
 	txcopy := *tx
-	txcopy.HashID = []byte{}
+	txcopy.Vin = make([]TXInput, len(tx.Vin))
+	for i, in := range tx.Vin{
+		if !tx.IsCoinbase(){
+			in.UnlockScript = nil
+		}
+		txcopy.Vin[i] = in
+	}
 	hash = sha256.Sum256(txcopy.Serialize())
 	return hash[:]
 }
 
-func (tx *Transaction) Sign(private ecdsa.PrivateKey, preTXs map[string]Transaction){
-	if tx.IsCoinbase(){
-		return
+// SignInput signs input idx, which spends the pay-to-pubkey-hash output
+// prevOut, and sets its unlock script to <signature> <pubkey>. The other
+// inputs are left alone so several parties can each sign their own.
+func (tx *Transaction) SignInput(idx int, private ecdsa.PrivateKey, prevOut TXOutput, hashType SigHashType) error{
+	signature, err := tx.CreateSignature(idx, private, prevOut, hashType)
+	if err != nil{
+		return err
 	}
-	for _,in := range tx.Vin{
-		if preTXs[hex.EncodeToString(in.TxID)]  == nil{
-			log.Panic("previous transaction not correct")
-		}
+	script := pushData(nil, signature)
+	tx.Vin[idx].UnlockScript = pushData(script, encodePubKey(&private.PublicKey))
+	return nil
+}
+
+// CreateSignature returns the signature of input idx, with hashType
+// appended, for use in an unlock script
+func (tx *Transaction) CreateSignature(idx int, private ecdsa.PrivateKey, prevOut TXOutput, hashType SigHashType) ([]byte, error){
+	hash, err := tx.SignatureHash(idx, prevOut, hashType)
+	if err != nil{
+		return nil, err
 	}
-	txcopy := tx.TrimmedCopy()
-	for inidx,in := range txcopy.Vin{
-		pretx := preTXs[hex.EncodeToString(in.TxID)]
-		txcopy.Vin[inidx].Signature = nil
-		txcopy.Vin[inidx].PubKey = pretx.Vout[in.PreOutIndex].PubKeyHash
-		dataToSign := fmt.Sprintf("%x\n", txcopy)
-		r,s,err := ecdsa.Sign(rand.Reader, &private, []byte{dataToSign})
-		if err != nil{
-			log.Panic(err)
-		}
-		/*txcopy.HashID = Hash(txcopy)
-		txcopy.Vin[inidx].PubKey = nil
-		r,s,err := ecdsa.Sign(rand.Reader, &private, txcopy.HashID)
-		if err != nil{
-			log.Panic(err)
-		}*/
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Vin[inidx].Signature = signature
-		txcopy.Vin[inidx].PubKey = nil
+	r,s,err := ecdsa.Sign(rand.Reader, &private, hash)
+	if err != nil{
+		return nil, err
+	}
+	signature, err := encodeSignature(r, s)
+	if err != nil{
+		return nil, err
 	}
+	return append(signature, byte(hashType)), nil
 }
 
 func (tx *Transaction) String() string{
 	var lines []string
 	lines = append(lines, fmt.Sprintf("Transaction: %x: ", tx.HashID))
+	if tx.LockTime != 0{
+		lines = append(lines, fmt.Sprintf("---LockTime is %d:", tx.LockTime))
+	}
 	for i, in := range tx.Vin{
 		lines = append(lines, fmt.Sprintf("---Input is %d:", i))
 		lines = append(lines, fmt.Sprintf("---TxID is %x:", in.TxID))
 		lines = append(lines, fmt.Sprintf("---PreOutIndex is %d:", in.PreOutIndex))
-		lines = append(lines, fmt.Sprintf("---Signature is %x:", in.Signature))
-		lines = append(lines, fmt.Sprintf("---PubKey is %x:", in.PubKey))
+		lines = append(lines, fmt.Sprintf("---UnlockScript is %s:", DisasmScript(in.UnlockScript)))
+		if in.Sequence != SequenceFinal{
+			lines = append(lines, fmt.Sprintf("---Sequence is %x:", in.Sequence))
+		}
 	}
 	for i,out := range tx.Vout{
 		lines = append(lines, fmt.Sprintf("---Output is %d:", i))
 		lines = append(lines, fmt.Sprintf("---Value is %d:", out.Value))
-		lines = append(lines, fmt.Sprintf("---PubKeyHash is %x:", out.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("---LockScript is %s:", DisasmScript(out.LockScript)))
 	}
 	return strings.Join(lines, "\n")
 }
@@ -111,56 +152,32 @@ func (tx *Transaction) TrimmedCopy() Transaction{
 	var inputs []TXInput
 	var outputs []TXOutput
 	for _,in := range tx.Vin{
-		input := TXInput{in.TxID, in.PreOutIndex, nil, nil}
+		input := TXInput{in.TxID, in.PreOutIndex, nil, in.Sequence}
 		inputs = append(inputs, input)
 	}
 	for _,out := range tx.Vout{
-		output := TXOutput{out.Value, out.PubKeyHash}
+		output := TXOutput{out.Value, out.LockScript}
 		outputs = append(outputs, output)
 	}
-	txcopy := Transaction{tx.HashID, inputs, outputs}
+	txcopy := Transaction{tx.HashID, inputs, outputs, tx.LockTime}
 	return txcopy
 }
 
-func (tx *Transaction) Verify(preTXs map[string]Transaction) bool{
-	if tx.IsCoinbase(){
-		return true
-	}
-	for _,in := range tx.Vin{
-		if preTXs[hex.EncodeToString(in.TxID)].HashID == nil{
-			log.Panic("preivous transaction not correct")
-		}
-	}
-	txcopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-	for inidx, in := range tx.Vin{
-		pretx := preTXs[hex.EncodeToString(in.TxID)]
-		txcopy.Vin[inidx].Signature = nil
-		txcopy.Vin[inidx].PubKey = pretx.Vout[in.PreOutIndex].PubKeyHash
-
-		r := big.Int{}
-		s := big.Int{}
-		siglen := len(in.Signature)
-		r.SetBytes(in.Signature[:(siglen/2)])
-		s.SetBytes(in.Signature[(siglen/2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keylen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keylen/2)])
-		y.SetBytes(in.PubKey[(keylen/2):])
-
-		dataToVerify := fmt.Sprintf("%x\n", txcopy)
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false{
-			return false
+// verifyScripts runs the scripts of every input, prevOuts[i] being the
+// output spent by tx.Vin[i]
+func (tx *Transaction) verifyScripts(prevOuts []TXOutput) error{
+	for inidx := range tx.Vin{
+		err := VerifyScript(tx, inidx, prevOuts[inidx])
+		if err != nil{
+			return fmt.Errorf("input %d: %w", inidx, err)
 		}
-		txcopy.Vin[inidx].PubKey = nil
 	}
-	return true
+	return nil
 }
 
-func NewCoinbaseTX(to, data string) *Transaction{
+// NewCoinbaseTX pays the subsidy of the block at height and the fees
+// collected by the block's other transactions to to
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction{
 	if data == ""{
 		randData := make([]byte,20)
 		_,err := rand.Read(randData)
@@ -170,89 +187,165 @@ func NewCoinbaseTX(to, data string) *Transaction{
 		data = fmt.Sprintf("%x", randData)
 		//data = fmt.Sprintf("reward to %s\n", to)
 	}
-	txin := TXInput{[]byte{}, -1,  nil,[]byte(data)}
-	txout := NewTXOutput{subsidy, to}
-	tx := Transaction{[]byte{}, []TXInput{txin}, []TXOutput{txout}}
+	txin := TXInput{[]byte{}, -1, pushData(nil, []byte(data)), SequenceFinal}
+	txout := *NewTXOutput(to, BlockSubsidy(height)+fees)
+	tx := Transaction{[]byte{}, []TXInput{txin}, []TXOutput{txout}, 0}
 	tx.HashID = tx.Hash()
 	return &tx
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction{
+// NewUTXOTransaction pays amount from wallet to to, plus fee to the miner.
+// A non-zero lockTime keeps it out of blocks until that height or time,
+// see IsFinal.
+func NewUTXOTransaction(wallet *Wallet, to string, amount int, fee Fee, lockTime uint32, UTXOSet *UTXOSet) *Transaction{
+	from := fmt.Sprintf("%s", wallet.GetAddress())
+	tx := newSpendTransaction(from, to, amount, fee, p2pkhUnlockSize, lockTime, UTXOSet)
+	UTXOSet.Blockchain.SignTransaction(tx, wallet.PrivateKey)
+	return tx
+}
+
+// NewMultisigTransaction spends from the multisig address ms. It comes back
+// unsigned, co-signers add their signatures with Multisig.Sign until
+// Multisig.IsComplete.
+func NewMultisigTransaction(ms *Multisig, to string, amount int, fee Fee, lockTime uint32, UTXOSet *UTXOSet) *Transaction{
+	from := fmt.Sprintf("%s", ms.GetAddress())
+	tx := newSpendTransaction(from, to, amount, fee, ms.unlockSize(), lockTime, UTXOSet)
+	for i := range tx.Vin{
+		tx.Vin[i].UnlockScript = ms.unsignedUnlock()
+	}
+	return tx
+}
+
+// newSpendTransaction pays amount from from's outputs to to, with the change
+// going back to from, and leaves the inputs unsigned. With a fee rate the
+// coins are picked again until they also cover the fee for the size the
+// transaction will have once its unlock scripts of unlockSize are in.
+func newSpendTransaction(from, to string, amount int, fee Fee, unlockSize int, lockTime uint32, UTXOSet *UTXOSet) *Transaction{
+	lockScript, err := AddressLockScript(from)
+	if err != nil{
+		log.Panic(err)
+	}
+	total := fee.Amount
+	for{
+		tx := buildSpend(from, to, amount, total, lockScript, lockTime, UTXOSet)
+		if fee.Rate == 0{
+			return tx
+		}
+		need := feeForSize(fee.Rate, estimateSize(tx, unlockSize))
+		if need <= total{
+			return tx
+		}
+		total = need
+	}
+}
+
+func buildSpend(from, to string, amount, fee int, lockScript []byte, lockTime uint32, UTXOSet *UTXOSet) *Transaction{
 	var inputs []TXInput
 	var outputs []TXOutput
-	pubkeyhash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs{pubkeyhash, amount}
-	if acc < amount{
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(lockScript, amount+fee)
+	if acc < amount+fee{
 		log.Panic("no enough funds")
 	}
+	// a lock time only applies when some input is not final
+	sequence := uint32(SequenceFinal)
+	if lockTime != 0{
+		sequence = SequenceFinal - 1
+	}
 	for id, outidxs := range validOutputs{
 		txid,err := hex.DecodeString(id)
 		if err != nil{
 			log.Panic(err)
 		}
 		for _,idx := range outidxs{
-			input := TXInput{txid, idx, nil, wallet.PublicKey}
+			input := TXInput{txid, idx, nil, sequence}
 			inputs = append(inputs, input)
 		}
 	}
-	from := fmt.Sprintf("%s", wallet.GetAddress())
 	outputs = append(outputs, *NewTXOutput(to, amount))
-	if acc > amount{
-		outputs = append(outputs, *NewTXOutput(from, acc - amount))
+	if acc > amount+fee{
+		outputs = append(outputs, *NewTXOutput(from, acc - amount - fee))
 	}
-	tx := Transaction{[]byte{}, inputs, outputs}
+	tx := Transaction{[]byte{}, inputs, outputs, lockTime}
 	tx.HashID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
 	return &tx
 }
 
-func DeserializeTransaction(data []byte) Transaction{
-	var transaction Transaction
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&transaction)
-	if err != nil{
-		log.Panic(err)
-	}
-	return transaction
+// DeserializeTransaction decodes a transaction and derives its id
+func DeserializeTransaction(data []byte) (Transaction, error){
+	d := &decoder{data: data}
+	tx := decodeTransaction(d)
+	return tx, d.finish()
 }
 
-func (in *TXInput) UseKey (pubkeyhash []byte) bool{
-	lockkey := HashPubKey(in.PubKey)
-	return bytes.Compare(lockKey, pubkeyhash) == 0
+// TXInput.PreOutIndex is written as a 32-bit value, -1 for coinbases
+func (in TXInput) encode(e *encoder){
+	e.writeVarBytes(in.TxID)
+	e.writeUint32(uint32(int32(in.PreOutIndex)))
+	e.writeVarBytes(in.UnlockScript)
+	e.writeUint32(in.Sequence)
 }
 
-func (out *TXOutput) Lock(address []byte){
-	pubkeyhash := Base58Decode(address)
-	pubkeyhash = pubkeyhash[1:len(pubkeyhash)-4]
-	out.PubKeyHash = pubkeyhash
+func decodeInput(d *decoder) TXInput{
+	var in TXInput
+	in.TxID = d.readVarBytes()
+	in.PreOutIndex = int(int32(d.readUint32()))
+	in.UnlockScript = d.readVarBytes()
+	in.Sequence = d.readUint32()
+	return in
 }
 
-func (out *TXOutput) IsLockedWithKey(pubkeyhash []byte) bool{
-	return bytes.Compare(out.PubKeyHash, pubkeyhash) == 0
+func (in TXInput) Serialize() []byte{
+	e := &encoder{}
+	in.encode(e)
+	return e.Bytes()
 }
 
-func NewTXOutput(address string, value int) *TXOutput{
-	out := &TXOutput{value, nil}
-	out.Lock([]byte(address))
+func DeserializeInput(data []byte) (TXInput, error){
+	d := &decoder{data: data}
+	in := decodeInput(d)
+	return in, d.finish()
+}
+
+func (out TXOutput) encode(e *encoder){
+	e.writeUint64(uint64(out.Value))
+	e.writeVarBytes(out.LockScript)
+}
+
+func decodeOutput(d *decoder) TXOutput{
+	var out TXOutput
+	out.Value = int(int64(d.readUint64()))
+	out.LockScript = d.readVarBytes()
 	return out
 }
 
-func (outs TXOutputs) Serialize() []byte{
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(outs)
-	if err != nil{
-		log.Panic(err)
-	}
-	return buf.Bytes()
+func (out TXOutput) Serialize() []byte{
+	e := &encoder{}
+	out.encode(e)
+	return e.Bytes()
+}
+
+func DeserializeOutput(data []byte) (TXOutput, error){
+	d := &decoder{data: data}
+	out := decodeOutput(d)
+	return out, d.finish()
 }
 
-func DeSerializeOutputs(data []byte) TXOutputs{
-	var outs TXOutputs
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&outs)
+func (out *TXOutput) Lock(address []byte){
+	script, err := AddressLockScript(string(address))
 	if err != nil{
 		log.Panic(err)
 	}
-	return outs
-}
\ No newline at end of file
+	out.LockScript = script
+}
+
+// IsLockedWithKey reports whether out pays to pubkeyhash alone
+func (out *TXOutput) IsLockedWithKey(pubkeyhash []byte) bool{
+	return bytes.Compare(extractPubKeyHash(out.LockScript), pubkeyhash) == 0
+}
+
+func NewTXOutput(address string, value int) *TXOutput{
+	out := &TXOutput{value, nil}
+	out.Lock([]byte(address))
+	return out
+}
+
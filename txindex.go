@@ -0,0 +1,128 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"github.com/boltdb/bolt"
+)
+
+// The transaction index maps each txid on the main chain to the hash of
+// its block and its position in it. It is optional: reindex-tx creates the
+// bucket, after which blocks are indexed as they are connected and
+// unindexed as they are disconnected. Without it FindTransaction walks the
+// chain.
+const txIndexBucket = "txindex"
+
+func txLocation(blockHash []byte, position int) []byte{
+	loc := make([]byte, len(blockHash)+4)
+	copy(loc, blockHash)
+	binary.BigEndian.PutUint32(loc[len(blockHash):], uint32(position))
+	return loc
+}
+
+func splitTxLocation(loc []byte) ([]byte, int){
+	n := len(loc) - 4
+	return loc[:n], int(binary.BigEndian.Uint32(loc[n:]))
+}
+
+// indexBlockTxs adds the transactions of block to the index, if there is one
+func indexBlockTxs(tx *bolt.Tx, block *Block) error{
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil{
+		return nil
+	}
+	for pos, t := range block.Transactions{
+		err := b.Put(t.HashID, txLocation(block.Hash, pos))
+		if err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexBlockTxs removes the entries indexBlockTxs added for block
+func unindexBlockTxs(tx *bolt.Tx, block *Block) error{
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil{
+		return nil
+	}
+	for _,t := range block.Transactions{
+		err := b.Delete(t.HashID)
+		if err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupTx returns the block hash and position of txid from the index.
+// ok is false when the index is missing or has no entry for txid.
+func lookupTx(tx *bolt.Tx, txid []byte) (blockHash []byte, position int, ok bool){
+	b := tx.Bucket([]byte(txIndexBucket))
+	if b == nil{
+		return nil, 0, false
+	}
+	loc := b.Get(txid)
+	if loc == nil{
+		return nil, 0, false
+	}
+	blockHash, position = splitTxLocation(loc)
+	return blockHash, position, true
+}
+
+// hasTxIndex reports whether the index is enabled
+func hasTxIndex(tx *bolt.Tx) bool{
+	return tx.Bucket([]byte(txIndexBucket)) != nil
+}
+
+// ReindexTransactions builds the transaction index from the main chain,
+// enabling it if it was off, and returns the number of transactions indexed
+func (bc *Blockchain) ReindexTransactions() int{
+	count := 0
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		err := tx.DeleteBucket([]byte(txIndexBucket))
+		if err != nil && err != bolt.ErrBucketNotFound{
+			return err
+		}
+		_, err = tx.CreateBucket([]byte(txIndexBucket))
+		if err != nil{
+			return err
+		}
+		b := tx.Bucket([]byte(blocksBucket))
+		for hash := b.Get([]byte("l")); len(hash) > 0;{
+			block, err := DeserializeBlock(b.Get(hash))
+			if err != nil{
+				return err
+			}
+			err = indexBlockTxs(tx, block)
+			if err != nil{
+				return err
+			}
+			count += len(block.Transactions)
+			hash = block.PreBlockHash
+		}
+		return nil
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return count
+}
+
+// indexedTransaction loads the transaction at blockHash and position
+func indexedTransaction(tx *bolt.Tx, txid, blockHash []byte, position int) (*Transaction, *Block, error){
+	data := tx.Bucket([]byte(blocksBucket)).Get(blockHash)
+	if data == nil{
+		return nil, nil, fmt.Errorf("transaction index points %x at unknown block %x", txid, blockHash)
+	}
+	block, err := DeserializeBlock(data)
+	if err != nil{
+		return nil, nil, err
+	}
+	if position >= len(block.Transactions) || !bytes.Equal(block.Transactions[position].HashID, txid){
+		return nil, nil, fmt.Errorf("transaction index entry for %x does not match block %x", txid, blockHash)
+	}
+	return block.Transactions[position], block, nil
+}
@@ -0,0 +1,54 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTransactionIndex(t *testing.T){
+	bc, wallet, spend := spendingChain(t)
+	address := string(wallet.GetAddress())
+	a3 := tipBlock(t, bc)
+	a1 := parentOf(t, bc, parentOf(t, bc, a3))
+	genesis := parentOf(t, bc, a1)
+	find := func(id []byte) bool{
+		tx, err := bc.FindTransaction(id)
+		if err == nil && !bytes.Equal(tx.HashID, id){
+			t.Fatalf("looked up %x, got %x", id, tx.HashID)
+		}
+		return err == nil
+	}
+	// without the index the chain is walked
+	if !find(spend.HashID){
+		t.Fatal("transaction not found without the index")
+	}
+	// genesis, three more coinbases and the spend
+	if n := bc.ReindexTransactions(); n != 5{
+		t.Fatal("indexed", n)
+	}
+	for _,id := range [][]byte{spend.HashID, genesis.Transactions[0].HashID, a3.Transactions[0].HashID}{
+		if !find(id){
+			t.Fatalf("%x not found", id)
+		}
+	}
+	if find([]byte("unknown")){
+		t.Fatal("found an unknown transaction")
+	}
+	// a reorganization away from the spend unindexes it
+	branch := a1
+	for i := 0; i < 3; i++{
+		branch = mineOn(bc, branch, address)
+		if _, err := bc.AddBlock(branch); err != nil{
+			t.Fatal(err)
+		}
+	}
+	if find(spend.HashID) || find(a3.Transactions[0].HashID) || !find(branch.Transactions[0].HashID){
+		t.Fatal("index does not follow the main chain")
+	}
+	maintained := bucketContents(t, bc, txIndexBucket)
+	bc.ReindexTransactions()
+	if !reflect.DeepEqual(maintained, bucketContents(t, bc, txIndexBucket)){
+		t.Fatal("maintained index differs from a rebuilt one")
+	}
+}
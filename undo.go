@@ -0,0 +1,193 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// Every connected block has an undo record holding the outputs it spent,
+// so it can be disconnected without rebuilding the UTXO set: by reorgs,
+// Rollback and InvalidateBlock.
+const undoBucket = "blockundo"
+
+// legacyUndoBucket held gob encoded undo records, see migrateUndo
+const legacyUndoBucket = "undo"
+
+// SpentOutput is an output removed from the UTXO set by a block
+type SpentOutput struct{
+	TxID 			[]byte
+	Index 		int
+	Entry 		UTXOEntry
+}
+
+// BlockUndo holds everything needed to take a block back out of the UTXO
+// set, in the order the outputs were spent
+type BlockUndo struct{
+	Spent []SpentOutput
+}
+
+// Serialize writes the number of spent outputs, then each one's outpoint
+// and UTXO entry
+func (u BlockUndo) Serialize() []byte{
+	e := &encoder{}
+	e.writeVarInt(uint64(len(u.Spent)))
+	for _,spent := range u.Spent{
+		e.writeVarBytes(spent.TxID)
+		e.writeUint32(uint32(spent.Index))
+		spent.Entry.encode(e)
+	}
+	return e.Bytes()
+}
+
+func DeserializeUndo(data []byte) (BlockUndo, error){
+	var undo BlockUndo
+	d := &decoder{data: data}
+	for i, n := 0, d.readCount(19); i < n; i++{
+		var spent SpentOutput
+		spent.TxID = d.readVarBytes()
+		spent.Index = int(d.readUint32())
+		spent.Entry = decodeUTXOEntry(d)
+		undo.Spent = append(undo.Spent, spent)
+	}
+	return undo, d.finish()
+}
+
+// migrateUndo re-encodes undo records written with gob
+func migrateUndo(tx *bolt.Tx) error{
+	legacy := tx.Bucket([]byte(legacyUndoBucket))
+	if legacy == nil{
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil{
+		return err
+	}
+	err = legacy.ForEach(func(k, v []byte)error{
+		var undo BlockUndo
+		err := gob.NewDecoder(bytes.NewReader(v)).Decode(&undo)
+		if err != nil{
+			return fmt.Errorf("%w: undo record of %x: %s", ErrMalformed, k, err)
+		}
+		return b.Put(k, undo.Serialize())
+	})
+	if err != nil{
+		return err
+	}
+	return tx.DeleteBucket([]byte(legacyUndoBucket))
+}
+
+// Blocks marked invalid by InvalidateBlock, keyed by hash. They and their
+// descendants are never connected again.
+const invalidBucket = "invalid"
+
+func isInvalid(tx *bolt.Tx, hash []byte) bool{
+	b := tx.Bucket([]byte(invalidBucket))
+	return b != nil && b.Get(hash) != nil
+}
+
+func markInvalid(tx *bolt.Tx, hash []byte) error{
+	b, err := tx.CreateBucketIfNotExists([]byte(invalidBucket))
+	if err != nil{
+		return err
+	}
+	return b.Put(hash, []byte{1})
+}
+
+// disconnectTip takes the tip block out of the UTXO set with its undo
+// record and makes its parent the tip
+func disconnectTip(tx *bolt.Tx) (*Block, error){
+	b := tx.Bucket([]byte(blocksBucket))
+	block, err := DeserializeBlock(b.Get(b.Get([]byte("l"))))
+	if err != nil{
+		return nil, err
+	}
+	if len(block.PreBlockHash) == 0{
+		return nil, errors.New("cannot disconnect the genesis block")
+	}
+	err = disconnectBlock(tx, block)
+	if err != nil{
+		return nil, err
+	}
+	return block, b.Put([]byte("l"), block.PreBlockHash)
+}
+
+// rollback disconnects tip blocks until the tip is at height, marking them
+// invalid when invalidate is set. It returns the disconnected blocks'
+// non-coinbase transactions.
+func rollback(tx *bolt.Tx, height int, invalidate bool) ([]*Transaction, error){
+	if height < 0{
+		return nil, fmt.Errorf("bad rollback height %d", height)
+	}
+	var txs []*Transaction
+	for getHeader(tx, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))).Height > height{
+		block, err := disconnectTip(tx)
+		if err != nil{
+			return nil, err
+		}
+		if invalidate{
+			err = markInvalid(tx, block.Hash)
+			if err != nil{
+				return nil, err
+			}
+		}
+		for _,t := range block.Transactions[1:]{
+			txs = append(txs, t)
+		}
+	}
+	return txs, nil
+}
+
+// Rollback disconnects blocks from the tip down to height, leaving them
+// stored so a chain with more work can connect them again
+func (bc *Blockchain) Rollback(height int) ([]*Transaction, error){
+	var txs []*Transaction
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		var err error
+		txs, err = rollback(tx, height, false)
+		if err != nil{
+			return err
+		}
+		bc.tail = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return nil
+	})
+	return txs, err
+}
+
+// InvalidateBlock marks the main chain block hash invalid and disconnects
+// it along with every block above it, which are marked invalid too
+func (bc *Blockchain) InvalidateBlock(hash []byte) ([]*Transaction, error){
+	var txs []*Transaction
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		header := getHeader(tx, hash)
+		if header == nil{
+			return fmt.Errorf("unknown block %x", hash)
+		}
+		if !onMainChain(tx, hash, header.Height){
+			return fmt.Errorf("block %x is not on the main chain", hash)
+		}
+		var err error
+		txs, err = rollback(tx, header.Height-1, true)
+		if err != nil{
+			return err
+		}
+		bc.tail = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return nil
+	})
+	return txs, err
+}
+
+// onMainChain reports whether the block hash at height is the tip or one
+// of its ancestors
+func onMainChain(tx *bolt.Tx, hash []byte, height int) bool{
+	current := tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+	for{
+		header := getHeader(tx, current)
+		if header.Height <= height{
+			return bytes.Equal(current, hash)
+		}
+		current = header.PreBlockHash
+	}
+}
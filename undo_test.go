@@ -0,0 +1,163 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"testing"
+	"github.com/boltdb/bolt"
+)
+
+func TestUndoEncodingRoundTrip(t *testing.T){
+	undo := BlockUndo{[]SpentOutput{
+		{bytes.Repeat([]byte{1}, 32), 0, UTXOEntry{TXOutput{10, []byte{2}}, 5, true}},
+		{bytes.Repeat([]byte{3}, 32), 7, UTXOEntry{TXOutput{4, []byte{5, 6}}, 9, false}},
+	}}
+	data := undo.Serialize()
+	got, err := DeserializeUndo(data)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, undo){
+		t.Fatalf("got %+v, want %+v", got, undo)
+	}
+	if _, err := DeserializeUndo(append(data, 0)); !errors.Is(err, ErrTrailingData){
+		t.Error("trailing data accepted", err)
+	}
+	for n := 0; n < len(data); n++{
+		if _, err := DeserializeUndo(data[:n]); !errors.Is(err, ErrMalformed){
+			t.Fatalf("cut to %d bytes: %v", n, err)
+		}
+	}
+}
+
+// spendingChain returns a chain of three blocks above genesis where the
+// second spends the genesis coinbase
+func spendingChain(t *testing.T) (*Blockchain, *Wallet, *Transaction){
+	old := CoinbaseMaturity
+	CoinbaseMaturity = 1
+	t.Cleanup(func(){ CoinbaseMaturity = old })
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	tip := extend(t, bc, 1, address)
+	spend := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, Fee{Amount: 1}, 0, &UTXOSet{bc})
+	tip = mineOn(bc, tip, address, spend)
+	if _, err := bc.AddBlock(tip); err != nil{
+		t.Fatal(err)
+	}
+	extend(t, bc, 1, address)
+	return bc, wallet, spend
+}
+
+func TestMigrateUndo(t *testing.T){
+	bc, _, _ := spendingChain(t)
+	records := make(map[string][]byte)
+	err := bc.db.Update(func(tx *bolt.Tx)error{
+		legacy, err := tx.CreateBucket([]byte(legacyUndoBucket))
+		if err != nil{
+			return err
+		}
+		err = tx.Bucket([]byte(undoBucket)).ForEach(func(k, v []byte)error{
+			records[string(k)] = append([]byte{}, v...)
+			undo, err := DeserializeUndo(v)
+			if err != nil{
+				return err
+			}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(undo); err != nil{
+				return err
+			}
+			return legacy.Put(k, buf.Bytes())
+		})
+		if err != nil{
+			return err
+		}
+		if err := tx.DeleteBucket([]byte(undoBucket)); err != nil{
+			return err
+		}
+		return migrateUndo(tx)
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	bc.db.View(func(tx *bolt.Tx)error{
+		if tx.Bucket([]byte(legacyUndoBucket)) != nil{
+			t.Error("legacy bucket kept")
+		}
+		b := tx.Bucket([]byte(undoBucket))
+		for k, v := range records{
+			if !bytes.Equal(b.Get([]byte(k)), v){
+				t.Errorf("record of %x changed", k)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRollbackRestoresUTXOSet(t *testing.T){
+	bc, wallet, spend := spendingChain(t)
+	oldTip := tipBlock(t, bc)
+	before := UTXOSet{bc}.Hash().Hash
+	txs, err := bc.Rollback(1)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || !bytes.Equal(txs[0].HashID, spend.HashID){
+		t.Fatal("returned transactions", txs)
+	}
+	if bc.GetBestHeight() != 1{
+		t.Fatal("height", bc.GetBestHeight())
+	}
+	// the set is what rebuilding it from the blocks gives
+	rolled := UTXOSet{bc}.Hash().Hash
+	UTXOSet{bc}.Reindex()
+	if !bytes.Equal(rolled, UTXOSet{bc}.Hash().Hash) || bytes.Equal(rolled, before){
+		t.Fatal("rolled back set differs from a rebuilt one")
+	}
+	// the disconnected blocks stay stored and connect again under a block
+	// with more work
+	next := mineOn(bc, oldTip, string(wallet.GetAddress()))
+	if _, err := bc.AddBlock(next); err != nil{
+		t.Fatal(err)
+	}
+	if bc.GetBestHeight() != oldTip.Height+1{
+		t.Fatal("height", bc.GetBestHeight())
+	}
+	if _, err := bc.Rollback(-1); err == nil{
+		t.Fatal("negative height accepted")
+	}
+}
+
+func TestInvalidateBlock(t *testing.T){
+	bc, wallet, _ := spendingChain(t)
+	address := string(wallet.GetAddress())
+	tip := tipBlock(t, bc)
+	bad, err := bc.GetBlock(tip.PreBlockHash)
+	if err != nil{
+		t.Fatal(err)
+	}
+	txs, err := bc.InvalidateBlock(bad.Hash)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || bc.GetBestHeight() != bad.Height-1{
+		t.Fatal("invalidate left height", bc.GetBestHeight(), len(txs))
+	}
+	// neither the block nor its descendants come back
+	if _, err := bc.AddBlock(mineOn(bc, tip, address)); !errors.Is(err, ErrInvalidated){
+		t.Fatal("descendant of an invalid block accepted", err)
+	}
+	// a competing branch from the parent becomes the chain
+	parent := tipBlock(t, bc)
+	branch := mineOn(bc, parent, address)
+	if _, err := bc.AddBlock(branch); err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.tail, branch.Hash){
+		t.Fatal("branch not connected")
+	}
+	if _, err := bc.InvalidateBlock(bad.Hash); err == nil{
+		t.Fatal("invalidated a block off the main chain")
+	}
+}
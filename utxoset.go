@@ -1,70 +1,236 @@
 package blockchain_practice
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/boltdb/bolt"
 	"log"
 	"encoding/hex"
+	"fmt"
 )
 
+// The UTXO bucket holds one entry per unspent output, keyed by the 32 byte
+// txid followed by the output index as a big-endian uint32, so the outputs
+// of a transaction sort next to each other.
+const utxoBucket = "utxo"
+
+// legacyUTXOBucket held a TXOutputs list per txid. Spending rewrote the list
+// without the spent output, which moved the ones after it, so it is
+// rebuilt rather than converted, see migrateUTXO.
+const legacyUTXOBucket = "chainstate"
+
+// The MuHash of every outpoint key and entry in the UTXO bucket, kept up
+// to date by updateUTXO and disconnectUTXO
+const utxoHashBucket = "utxohash"
+
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.db
-	bucketName := []byte(utxoBucket)
-	err := db.Update(func(tx *bolt.Tx)error{
-		err := tx.DeleteBucket(bucketName)
-		if err != nil{
-			log.Panic(err)
-		}
-		_, err = tx.CreateBucket(bucketName)
+// UTXOEntry is an unspent output and where it was created
+type UTXOEntry struct{
+	Output 		TXOutput
+	Height 		int
+	IsCoinbase 	bool
+}
+
+func outpointKey(txid []byte, index int) []byte{
+	key := make([]byte, len(txid)+4)
+	copy(key, txid)
+	binary.BigEndian.PutUint32(key[len(txid):], uint32(index))
+	return key
+}
+
+func splitOutpointKey(key []byte) ([]byte, int){
+	n := len(key) - 4
+	return key[:n], int(binary.BigEndian.Uint32(key[n:]))
+}
+
+func (entry UTXOEntry) encode(e *encoder){
+	e.writeUint32(uint32(entry.Height))
+	coinbase := uint64(0)
+	if entry.IsCoinbase{
+		coinbase = 1
+	}
+	e.writeVarInt(coinbase)
+	entry.Output.encode(e)
+}
+
+func decodeUTXOEntry(d *decoder) UTXOEntry{
+	var entry UTXOEntry
+	entry.Height = int(d.readUint32())
+	switch d.readVarInt(){
+	case 0:
+	case 1:
+		entry.IsCoinbase = true
+	default:
+		d.fail("bad coinbase flag")
+	}
+	entry.Output = decodeOutput(d)
+	return entry
+}
+
+func (entry UTXOEntry) Serialize() []byte{
+	e := &encoder{}
+	entry.encode(e)
+	return e.Bytes()
+}
+
+func DeserializeUTXOEntry(data []byte) (UTXOEntry, error){
+	d := &decoder{data: data}
+	entry := decodeUTXOEntry(d)
+	return entry, d.finish()
+}
+
+// Mature reports whether the entry may be spent by a block at height
+func (entry UTXOEntry) Mature(height int) bool{
+	return !entry.IsCoinbase || height-entry.Height >= CoinbaseMaturity
+}
+
+// UTXOSetHash commits to the UTXO set as of the block BlockHash
+type UTXOSetHash struct{
+	BlockHash 	[]byte
+	Height 		int
+	Hash 			[]byte
+}
+
+func utxoHashElement(txid []byte, index int, entry UTXOEntry) []byte{
+	return append(outpointKey(txid, index), entry.Serialize()...)
+}
+
+func loadUTXOHash(tx *bolt.Tx) (*MuHash, error){
+	b := tx.Bucket([]byte(utxoHashBucket))
+	if b == nil || b.Get([]byte("h")) == nil{
+		return NewMuHash(), nil
+	}
+	return DeserializeMuHash(b.Get([]byte("h")))
+}
+
+func storeUTXOHash(tx *bolt.Tx, h *MuHash) error{
+	b, err := tx.CreateBucketIfNotExists([]byte(utxoHashBucket))
+	if err != nil{
+		return err
+	}
+	return b.Put([]byte("h"), h.Serialize())
+}
+
+// buildUTXOHash hashes the UTXO bucket, for databases written before the
+// hash was kept
+func buildUTXOHash(tx *bolt.Tx) error{
+	if tx.Bucket([]byte(utxoHashBucket)) != nil{
+		return nil
+	}
+	ub := tx.Bucket([]byte(utxoBucket))
+	if ub == nil{
+		return nil
+	}
+	fmt.Println("hashing the UTXO set")
+	h := NewMuHash()
+	c := ub.Cursor()
+	for k,v:=c.First();k!=nil;k,v=c.Next(){
+		h.Add(append(append([]byte{}, k...), v...))
+	}
+	return storeUTXOHash(tx, h)
+}
+
+// Hash returns the hash of the UTXO set and the tip it is at
+func (u UTXOSet) Hash() UTXOSetHash{
+	var result UTXOSetHash
+	err := u.Blockchain.db.View(func(tx *bolt.Tx)error{
+		h, err := loadUTXOHash(tx)
 		if err != nil{
-			log.Panic(err)
+			return err
 		}
+		result.BlockHash = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		result.Height = getHeader(tx, result.BlockHash).Height
+		result.Hash = h.Digest()
 		return nil
 	})
 	if err != nil{
 		log.Panic(err)
 	}
-	UTXO := u.Blockchain.FindUTXO()
-	err = db.Update(func(tx *bolt.Tx)error{
-		b := tx.Bucket(bucketName)
-		for id, outs := range UTXO{
-			key, err := hex.DecodeString(id)
-			if err != nil{
-				log.Panic(err)
-			}
-			err = b.Put(key, outs.Serialize())
-			if err != nil{
-				log.Panic(err)
-			}
-		}
-		return nil
+	return result
+}
+
+func (u UTXOSet) Reindex() {
+	db := u.Blockchain.db
+	err := db.Update(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(blocksBucket))
+		return reindexUTXO(tx, b.Get([]byte("l")))
 	})
 	if err != nil{
 		log.Panic(err)
 	}
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubkeyhash []byte, amount int) (int, map[string][]int) {
-	var unspentOutputs map[string][]int
+// reindexUTXO rebuilds the UTXO bucket, and the undo records with it, by
+// replaying the chain ending at tip from the genesis block
+func reindexUTXO(tx *bolt.Tx, tip []byte) error{
+	for _,name := range []string{utxoBucket, addrIndexBucket, utxoHashBucket, undoBucket, legacyUndoBucket}{
+		err := tx.DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound{
+			return err
+		}
+	}
+	for _,name := range []string{utxoBucket, addrIndexBucket}{
+		_, err := tx.CreateBucket([]byte(name))
+		if err != nil{
+			return err
+		}
+	}
+	var hashes [][]byte
+	for hash := tip; len(hash) > 0; hash = getHeader(tx, hash).PreBlockHash{
+		hashes = append(hashes, hash)
+	}
+	b := tx.Bucket([]byte(blocksBucket))
+	for i:=len(hashes)-1;i>=0;i--{
+		block, err := DeserializeBlock(b.Get(hashes[i]))
+		if err != nil{
+			return err
+		}
+		err = updateUTXO(tx, block)
+		if err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUTXO replaces a UTXO set in the legacy layout and adds the
+// address index and set hash if they are missing
+func migrateUTXO(tx *bolt.Tx) error{
+	if tx.Bucket([]byte(legacyUTXOBucket)) == nil{
+		err := buildAddrIndex(tx)
+		if err != nil{
+			return err
+		}
+		return buildUTXOHash(tx)
+	}
+	fmt.Println("rebuilding the UTXO set keyed by outpoint")
+	err := reindexUTXO(tx, tx.Bucket([]byte(blocksBucket)).Get([]byte("l")))
+	if err != nil{
+		return err
+	}
+	return tx.DeleteBucket([]byte(legacyUTXOBucket))
+}
+
+// FindSpendableOutputs collects outputs locked by lockScript until they
+// add up to amount, leaving out coinbase outputs the next block could not
+// spend yet
+func (u UTXOSet) FindSpendableOutputs(lockScript []byte, amount int) (int, map[string][]int) {
+	unspentOutputs := make(map[string][]int)
 	acc := 0
 	db := u.Blockchain.db
 	err := db.View(func(tx *bolt.Tx)error{
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-		for k,v:=c.First();k!=nil;k,v=c.Next(){
-			txid := hex.EncodeToString(k)
-			outs := DeSerializeOutputs(v)
-			for index, out := range outs.Outputs{
-				if out.IsLockedWithKey(pubkeyhash) && acc < amount{
-					acc += out.Value
-					unspentOutputs[txid] = append(unspentOutputs[txid], index)
-				}
+		tip := getHeader(tx, tx.Bucket([]byte(blocksBucket)).Get([]byte("l")))
+		return forEachLockedBy(tx, lockScript, func(txid []byte, index int, entry UTXOEntry) bool{
+			if entry.Mature(tip.Height+1){
+				id := hex.EncodeToString(txid)
+				acc += entry.Output.Value
+				unspentOutputs[id] = append(unspentOutputs[id], index)
 			}
-		}
-		return nil
+			return acc < amount
+		})
 	})
 	if err != nil{
 		log.Panic(err)
@@ -72,21 +238,14 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyhash []byte, amount int) (int, map[s
 	return acc, unspentOutputs
 }
 
-func (u UTXOSet) FindUTXO(pubkeyhash []byte) []TXOutput{
+// FindUTXO returns the unspent outputs locked by lockScript
+func (u UTXOSet) FindUTXO(lockScript []byte) []TXOutput{
 	var UTXOs []TXOutput
-	db := u.Blockchain.db
-	err := db.View(func(tx *bolt.Tx)error{
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-		for k,v:=c.First();k!=nil;k,v=c.Next(){
-			outs := DeSerializeOutputs(v)
-			for _,out := range outs.Outputs{
-				if out.IsLockedWithKey(pubkeyhash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
-		}
-		return nil
+	err := u.Blockchain.db.View(func(tx *bolt.Tx)error{
+		return forEachLockedBy(tx, lockScript, func(txid []byte, index int, entry UTXOEntry) bool{
+			UTXOs = append(UTXOs, entry.Output)
+			return true
+		})
 	})
 	if err != nil{
 		log.Panic(err)
@@ -94,16 +253,15 @@ func (u UTXOSet) FindUTXO(pubkeyhash []byte) []TXOutput{
 	return UTXOs
 }
 
+// CountTransactions returns how many transactions have unspent outputs
 func (u UTXOSet) CountTransactions() int{
 	count := 0
-	db := u.Blockchain.db
-	err := db.View(func(tx *bolt.Tx)error{
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-		for k,_:=c.First();k!=nil;k,_=c.Next(){
+	var last []byte
+	err := u.forEach(func(txid []byte, index int, entry UTXOEntry){
+		if !bytes.Equal(txid, last){
 			count++
+			last = txid
 		}
-		return nil
 	})
 	if err != nil{
 		log.Panic(err)
@@ -111,46 +269,224 @@ func (u UTXOSet) CountTransactions() int{
 	return count
 }
 
+// TotalSupply returns the value of all unspent outputs, which is every
+// coin issued so far less any subsidy or fees miners did not claim
+func (u UTXOSet) TotalSupply() int{
+	total := 0
+	err := u.forEach(func(txid []byte, index int, entry UTXOEntry){
+		total += entry.Output.Value
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+	return total
+}
+
+// forEach calls fn for every unspent output in key order. txid is only
+// valid during the call.
+func (u UTXOSet) forEach(fn func(txid []byte, index int, entry UTXOEntry)) error{
+	return u.Blockchain.db.View(func(tx *bolt.Tx)error{
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+		for k,v:=c.First();k!=nil;k,v=c.Next(){
+			entry, err := DeserializeUTXOEntry(v)
+			if err != nil{
+				return err
+			}
+			txid, index := splitOutpointKey(k)
+			fn(txid, index, entry)
+		}
+		return nil
+	})
+}
+
 func (u UTXOSet) Update(block *Block) {
 	db := u.Blockchain.db
 	err := db.Update(func(tx *bolt.Tx)error{
-		b := tx.Bucket([]byte(utxoBucket))
-		for _,tx := range block.Transactions{
-			if tx.IsCoinbase() == false{
-				for _,in := range tx.Vin{
-					updatedOuts := TXOutputs{}
-					preoutsData := b.Get(in.TxID)
-					outs := DeSerializeOutputs(preoutsData)
-					for index, out := range outs.Outputs{
-						if index != in.PreOutIndex{
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-					if len(updatedOuts.Outputs) == 0{
-						err := b.Delete(in.TxID)
-						if err != nil{
-							log.Panic(err)
-						}
-					}else{
-						err := b.Put(in.TxID, updatedOuts.Serialize())
-						if err != nil{
-							log.Panic(err)
-						}
-					}
+		return updateUTXO(tx, block)
+	})
+	if err != nil{
+		log.Panic(err)
+	}
+}
+
+// updateUTXO applies block to the UTXO set and stores the undo record that
+// lets disconnectUTXO take it back out
+func updateUTXO(dbtx *bolt.Tx, block *Block) error{
+	b := dbtx.Bucket([]byte(utxoBucket))
+	ib := dbtx.Bucket([]byte(addrIndexBucket))
+	h, err := loadUTXOHash(dbtx)
+	if err != nil{
+		return err
+	}
+	undo := BlockUndo{}
+	for _,tx := range block.Transactions{
+		if tx.IsCoinbase() == false{
+			for _,in := range tx.Vin{
+				entry, ok := findUnspentOutput(b, in.TxID, in.PreOutIndex)
+				if !ok{
+					return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.TxID, in.PreOutIndex)
 				}
+				err := b.Delete(outpointKey(in.TxID, in.PreOutIndex))
+				if err != nil{
+					return err
+				}
+				err = unindexOutput(ib, entry.Output.LockScript, in.TxID, in.PreOutIndex)
+				if err != nil{
+					return err
+				}
+				h.Remove(utxoHashElement(in.TxID, in.PreOutIndex, entry))
+				undo.Spent = append(undo.Spent, SpentOutput{in.TxID, in.PreOutIndex, entry})
+			}
+		}
+		for index, out := range tx.Vout{
+			entry := UTXOEntry{out, block.Height, tx.IsCoinbase()}
+			if b.Get(outpointKey(tx.HashID, index)) != nil{
+				return fmt.Errorf("%w: %x:%d", ErrDuplicateOutput, tx.HashID, index)
 			}
-			newOuts := TXOutputs{}
-			for _, out := range tx.Vout{
-				newOuts.Outputs = append(newOuts.Outputs, out)
+			err := b.Put(outpointKey(tx.HashID, index), entry.Serialize())
+			if err != nil{
+				return err
 			}
-			err := b.Put(tx.HashID, newOuts.Serialize())
+			err = indexOutput(ib, out.LockScript, tx.HashID, index)
 			if err != nil{
-				log.Panic(err)
+				return err
 			}
+			h.Add(utxoHashElement(tx.HashID, index, entry))
+		}
+	}
+	err = storeUTXOHash(dbtx, h)
+	if err != nil{
+		return err
+	}
+	ub, err := dbtx.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil{
+		return err
+	}
+	return ub.Put(block.Hash, undo.Serialize())
+}
+
+// disconnectUTXO reverses updateUTXO for the current tip block
+func disconnectUTXO(dbtx *bolt.Tx, block *Block) error{
+	b := dbtx.Bucket([]byte(utxoBucket))
+	ib := dbtx.Bucket([]byte(addrIndexBucket))
+	ub := dbtx.Bucket([]byte(undoBucket))
+	if ub == nil || ub.Get(block.Hash) == nil{
+		return fmt.Errorf("no undo data for block %x", block.Hash)
+	}
+	undo, err := DeserializeUndo(ub.Get(block.Hash))
+	if err != nil{
+		return fmt.Errorf("undo record of block %x: %w", block.Hash, err)
+	}
+	h, err := loadUTXOHash(dbtx)
+	if err != nil{
+		return err
+	}
+	created := make(map[string]bool)
+	for _,tx := range block.Transactions{
+		for index, out := range tx.Vout{
+			// outputs spent later in the block are already gone
+			if entry, ok := findUnspentOutput(b, tx.HashID, index); ok{
+				h.Remove(utxoHashElement(tx.HashID, index, entry))
+			}
+			err := b.Delete(outpointKey(tx.HashID, index))
+			if err != nil{
+				return err
+			}
+			err = unindexOutput(ib, out.LockScript, tx.HashID, index)
+			if err != nil{
+				return err
+			}
+		}
+		created[hex.EncodeToString(tx.HashID)] = true
+	}
+	for _,spent := range undo.Spent{
+		// outputs created and spent within the block were never in the set
+		if created[hex.EncodeToString(spent.TxID)]{
+			continue
+		}
+		err := b.Put(outpointKey(spent.TxID, spent.Index), spent.Entry.Serialize())
+		if err != nil{
+			return err
+		}
+		err = indexOutput(ib, spent.Entry.Output.LockScript, spent.TxID, spent.Index)
+		if err != nil{
+			return err
+		}
+		h.Add(utxoHashElement(spent.TxID, spent.Index, spent.Entry))
+	}
+	err = storeUTXOHash(dbtx, h)
+	if err != nil{
+		return err
+	}
+	return ub.Delete(block.Hash)
+}
+
+// SpentOutputs returns the outputs tx's inputs spend, in input order.
+// Every input has to be in the UTXO set.
+func (u UTXOSet) SpentOutputs(tx *Transaction) ([]TXOutput, error){
+	var prevOuts []TXOutput
+	err := u.Blockchain.db.View(func(dbtx *bolt.Tx)error{
+		b := dbtx.Bucket([]byte(utxoBucket))
+		for _,in := range tx.Vin{
+			entry, ok := findUnspentOutput(b, in.TxID, in.PreOutIndex)
+			if !ok{
+				return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.TxID, in.PreOutIndex)
+			}
+			prevOuts = append(prevOuts, entry.Output)
 		}
 		return nil
 	})
+	return prevOuts, err
+}
+
+// TransactionFee returns the fee tx pays, its inputs less its outputs.
+// Every input has to be in the UTXO set.
+func (u UTXOSet) TransactionFee(tx *Transaction) (int, error){
+	prevOuts, err := u.SpentOutputs(tx)
+	if err != nil{
+		return 0, err
+	}
+	fee := 0
+	for _,out := range prevOuts{
+		fee += out.Value
+	}
+	for _,out := range tx.Vout{
+		fee -= out.Value
+	}
+	return fee, nil
+}
+
+// findUnspentOutput looks up output index of txid in the UTXO bucket
+func findUnspentOutput(b *bolt.Bucket, txid []byte, index int) (UTXOEntry, bool){
+	if index < 0{
+		return UTXOEntry{}, false
+	}
+	data := b.Get(outpointKey(txid, index))
+	if data == nil{
+		return UTXOEntry{}, false
+	}
+	entry, err := DeserializeUTXOEntry(data)
 	if err != nil{
 		log.Panic(err)
 	}
-}
\ No newline at end of file
+	return entry, true
+}
+
+// CheckMaturity fails unless every input of tx is unspent and may be spent
+// by a block at height
+func (u UTXOSet) CheckMaturity(tx *Transaction, height int) error{
+	return u.Blockchain.db.View(func(dbtx *bolt.Tx)error{
+		b := dbtx.Bucket([]byte(utxoBucket))
+		for _,in := range tx.Vin{
+			entry, ok := findUnspentOutput(b, in.TxID, in.PreOutIndex)
+			if !ok{
+				return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.TxID, in.PreOutIndex)
+			}
+			if !entry.Mature(height){
+				return fmt.Errorf("%w: %x:%d", ErrImmatureSpend, in.TxID, in.PreOutIndex)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,287 @@
+package blockchain_practice
+
+import (
+	"errors"
+	"fmt"
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+var (
+	ErrBadProofOfWork = errors.New("bad proof of work")
+	ErrBadBlockHash = errors.New("block hash does not match its header")
+	ErrBadMerkleRoot = errors.New("merkle root does not match transactions")
+	ErrUnknownParent = errors.New("unknown parent block")
+	ErrBadHeight = errors.New("wrong block height")
+	ErrBadCoinbase = errors.New("malformed coinbase")
+	ErrOversizedCoinbase = errors.New("coinbase pays more than subsidy and fees")
+	ErrInvalidTx = errors.New("invalid transaction")
+	ErrMissingInput = errors.New("input spends an unknown output")
+	ErrDuplicateSpend = errors.New("output spent twice")
+	ErrImmatureSpend = errors.New("coinbase output spent before maturity")
+	ErrDuplicateOutput = errors.New("output already exists")
+	ErrInvalidated = errors.New("block or an ancestor was invalidated")
+	ErrBadTimestamp = errors.New("block timestamp not after median time past")
+	ErrFutureBlock = errors.New("block timestamp too far in the future")
+)
+
+// A block's timestamp has to be later than the median of the
+// medianTimeBlocks timestamps before it, and at most maxFutureBlockTime
+// seconds ahead of our clock. The retarget and time locks depend on
+// timestamps, so one miner cannot move them far.
+const (
+	medianTimeBlocks = 11
+	maxFutureBlockTime = 2 * 60 * 60
+)
+
+// BlockError reports why a block was rejected. Err is one of the Err*
+// values above so callers can tell failures apart with errors.Is.
+type BlockError struct{
+	Hash 		[]byte
+	Err 		error
+	Reason 	string
+}
+
+func (e *BlockError) Error() string{
+	if e.Reason == ""{
+		return fmt.Sprintf("block %x rejected: %s", e.Hash, e.Err)
+	}
+	return fmt.Sprintf("block %x rejected: %s: %s", e.Hash, e.Err, e.Reason)
+}
+
+func (e *BlockError) Unwrap() error{
+	return e.Err
+}
+
+func blockError(block *Block, err error, format string, args ...interface{}) error{
+	return &BlockError{block.Hash, err, fmt.Sprintf(format, args...)}
+}
+
+// ValidateBlock checks a block received from a peer before it is stored
+func (bc *Blockchain) ValidateBlock(block *Block) error{
+	return bc.db.View(func(tx *bolt.Tx)error{
+		return validateBlock(tx, block)
+	})
+}
+
+// validateBlock runs the header and transaction checks. Inputs can only be
+// checked against the UTXO set when the block builds on the current tip.
+func validateBlock(tx *bolt.Tx, block *Block) error{
+	err := checkBlock(tx, block)
+	if err != nil{
+		return err
+	}
+	b := tx.Bucket([]byte(blocksBucket))
+	if bytes.Equal(b.Get([]byte("l")), block.PreBlockHash){
+		return checkBlockInputs(tx, block)
+	}
+	return nil
+}
+
+// checkBlock runs every check that does not depend on the UTXO set
+func checkBlock(tx *bolt.Tx, block *Block) error{
+	parent := getHeader(tx, block.PreBlockHash)
+	if len(block.PreBlockHash) == 0 || parent == nil{
+		return blockError(block, ErrUnknownParent, "%x", block.PreBlockHash)
+	}
+	// headers are stored ahead of their blocks during sync
+	if tx.Bucket([]byte(blocksBucket)).Get(block.PreBlockHash) == nil{
+		return blockError(block, ErrUnknownParent, "%x not downloaded yet", block.PreBlockHash)
+	}
+	if isInvalid(tx, block.Hash) || isInvalid(tx, block.PreBlockHash){
+		return blockError(block, ErrInvalidated, "")
+	}
+	if block.Height != parent.Height+1{
+		return blockError(block, ErrBadHeight, "got %d, parent is at %d", block.Height, parent.Height)
+	}
+	if err := checkTimestamp(tx, parent, block); err != nil{
+		return err
+	}
+	if err := checkProofOfWork(tx, parent, block); err != nil{
+		return err
+	}
+	if root := block.HashTransactions(); !bytes.Equal(block.MerkleRoot, root){
+		return blockError(block, ErrBadMerkleRoot, "computed %x", root)
+	}
+	return checkTransactions(block)
+}
+
+func checkTimestamp(tx *bolt.Tx, parent *BlockHeader, block *Block) error{
+	if mtp := medianTimePast(tx, parent); block.Timestamp <= mtp{
+		return blockError(block, ErrBadTimestamp, "%d, median time past is %d", block.Timestamp, mtp)
+	}
+	if limit := time.Now().Unix()+maxFutureBlockTime; block.Timestamp > limit{
+		return blockError(block, ErrFutureBlock, "%d, limit is %d", block.Timestamp, limit)
+	}
+	return nil
+}
+
+// medianTimePast returns the median timestamp of the medianTimeBlocks
+// blocks ending at header, or of all of them near genesis
+func medianTimePast(tx *bolt.Tx, header *BlockHeader) int64{
+	var times []int64
+	for len(times) < medianTimeBlocks && header != nil{
+		times = append(times, header.Timestamp)
+		if len(header.PreBlockHash) == 0{
+			break
+		}
+		header = getHeader(tx, header.PreBlockHash)
+	}
+	sort.Slice(times, func(i, j int) bool{
+		return times[i] < times[j]
+	})
+	return times[len(times)/2]
+}
+
+func checkProofOfWork(tx *bolt.Tx, parent *BlockHeader, block *Block) error{
+	if expected := nextBits(tx, parent); block.Bits != expected{
+		return blockError(block, ErrBadProofOfWork, "bits %08x, expected %08x", block.Bits, expected)
+	}
+	pow := NewProofOfWork(block)
+	hash := pow.hash()
+	if !bytes.Equal(hash, block.Hash){
+		return blockError(block, ErrBadBlockHash, "computed %x", hash)
+	}
+	if !pow.meetsTarget(hash){
+		return blockError(block, ErrBadProofOfWork, "hash above target")
+	}
+	return nil
+}
+
+// checkTransactions runs the checks that need nothing but the block itself
+func checkTransactions(block *Block) error{
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase(){
+		return blockError(block, ErrBadCoinbase, "first transaction is not a coinbase")
+	}
+	ids := make(map[string]bool)
+	for i, tx := range block.Transactions{
+		if i > 0 && tx.IsCoinbase(){
+			return blockError(block, ErrBadCoinbase, "extra coinbase at %d", i)
+		}
+		if err := checkTransaction(tx); err != nil{
+			return blockError(block, ErrInvalidTx, "%x: %s", tx.HashID, err)
+		}
+		if ids[hex.EncodeToString(tx.HashID)]{
+			return blockError(block, ErrDuplicateOutput, "%x is in the block twice", tx.HashID)
+		}
+		ids[hex.EncodeToString(tx.HashID)] = true
+	}
+	return nil
+}
+
+// checkTransaction runs the checks that need nothing but tx itself
+func checkTransaction(tx *Transaction) error{
+	if !bytes.Equal(tx.HashID, tx.Hash()){
+		return errors.New("id does not match contents")
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0{
+		return errors.New("no inputs or outputs")
+	}
+	spent := make(map[string]bool)
+	for _,in := range tx.Vin{
+		outpoint := fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)
+		if spent[outpoint]{
+			return fmt.Errorf("spends %s twice", outpoint)
+		}
+		spent[outpoint] = true
+	}
+	total := 0
+	for _,out := range tx.Vout{
+		if out.Value <= 0{
+			return errors.New("non-positive output")
+		}
+		total += out.Value
+		if out.Value > MaxMoney || !moneyRange(total){
+			return errors.New("outputs above the money limit")
+		}
+	}
+	return nil
+}
+
+// checkBlockInputs resolves every input against the UTXO set or an earlier
+// transaction of the same block, runs its scripts and checks amounts and
+// time locks. No transaction may create an output that is still unspent:
+// overwriting it would lose the coins and leave the UTXO hash and the undo
+// records unable to account for them.
+func checkBlockInputs(dbtx *bolt.Tx, block *Block) error{
+	utxo := dbtx.Bucket([]byte(utxoBucket))
+	for _,tx := range block.Transactions{
+		for index := range tx.Vout{
+			if _, ok := findUnspentOutput(utxo, tx.HashID, index); ok{
+				return blockError(block, ErrDuplicateOutput, "%x:%d is unspent", tx.HashID, index)
+			}
+		}
+	}
+	parentTime := medianTimePast(dbtx, getHeader(dbtx, block.PreBlockHash))
+	if !block.Transactions[0].IsFinal(block.Height, parentTime){
+		return blockError(block, ErrBadCoinbase, "locked until %d", block.Transactions[0].LockTime)
+	}
+	spent := make(map[string]bool)
+	created := make(map[string]*Transaction)
+	fees := 0
+	for _,tx := range block.Transactions[1:]{
+		var prevOuts []TXOutput
+		inValue := 0
+		for _,in := range tx.Vin{
+			outpoint := fmt.Sprintf("%x:%d", in.TxID, in.PreOutIndex)
+			if spent[outpoint]{
+				return blockError(block, ErrDuplicateSpend, "%s", outpoint)
+			}
+			spent[outpoint] = true
+			var out TXOutput
+			found := false
+			if pretx, ok := created[hex.EncodeToString(in.TxID)]; ok{
+				if in.PreOutIndex >= 0 && in.PreOutIndex < len(pretx.Vout){
+					out, found = pretx.Vout[in.PreOutIndex], true
+				}
+			}else{
+				var entry UTXOEntry
+				entry, found = findUnspentOutput(utxo, in.TxID, in.PreOutIndex)
+				if found && !entry.Mature(block.Height){
+					return blockError(block, ErrImmatureSpend, "%s created at height %d", outpoint, entry.Height)
+				}
+				out = entry.Output
+			}
+			if !found{
+				return blockError(block, ErrMissingInput, "%s", outpoint)
+			}
+			prevOuts = append(prevOuts, out)
+			inValue += out.Value
+			if !moneyRange(out.Value) || !moneyRange(inValue){
+				return blockError(block, ErrInvalidTx, "%x: inputs above the money limit", tx.HashID)
+			}
+		}
+		// checkTransactions has bounded every output and their sum
+		outValue := 0
+		for _,out := range tx.Vout{
+			outValue += out.Value
+		}
+		if inValue < outValue{
+			return blockError(block, ErrInvalidTx, "%x: spends %d but has %d", tx.HashID, outValue, inValue)
+		}
+		if err := checkLocks(dbtx, tx, block.PreBlockHash, block.Height, created); err != nil{
+			return blockError(block, ErrInvalidTx, "%x: %s", tx.HashID, err)
+		}
+		if err := tx.verifyScripts(prevOuts); err != nil{
+			return blockError(block, ErrInvalidTx, "%x: %s", tx.HashID, err)
+		}
+		fees += inValue - outValue
+		if !moneyRange(fees){
+			return blockError(block, ErrInvalidTx, "fees above the money limit")
+		}
+		created[hex.EncodeToString(tx.HashID)] = tx
+	}
+	reward := 0
+	for _,out := range block.Transactions[0].Vout{
+		reward += out.Value
+	}
+	// the reward is bounded by checkTransactions and fees above, so
+	// neither side of the comparison can overflow
+	if allowed := BlockSubsidy(block.Height)+fees; reward > allowed{
+		return blockError(block, ErrOversizedCoinbase, "pays %d, allowed %d", reward, allowed)
+	}
+	return nil
+}
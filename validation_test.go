@@ -0,0 +1,104 @@
+package blockchain_practice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCheckTransactionsMoneyRange(t *testing.T){
+	tests := []struct{
+		name 	string
+		values 	[]int
+		ok 		bool
+	}{
+		{"largest output", []int{MaxMoney}, true},
+		{"output above the limit", []int{MaxMoney + 1}, false},
+		{"outputs summing above the limit", []int{MaxMoney, 1}, false},
+		{"outputs wrapping around", []int{math.MaxInt64, math.MaxInt64, 2}, false},
+	}
+	for _,test := range tests{
+		coinbase := testBlock().Transactions[0]
+		tx := testTransaction()
+		tx.Vout = nil
+		for _,value := range test.values{
+			tx.Vout = append(tx.Vout, TXOutput{value, []byte{1}})
+		}
+		tx.HashID = tx.Hash()
+		err := checkTransactions(&Block{Transactions: []*Transaction{coinbase, &tx}})
+		if test.ok && err != nil || !test.ok && !errors.Is(err, ErrInvalidTx){
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestBlockTimestampRules(t *testing.T){
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	genesis := tipBlock(t, bc)
+	tip := extend(t, bc, medianTimeBlocks, address)
+	// the last eleven blocks are 10 to 110 seconds after genesis
+	mtp := genesis.Timestamp + 6*targetBlockTime
+	if _, err := bc.AddBlock(mineAt(bc, tip, mtp, address)); !errors.Is(err, ErrBadTimestamp){
+		t.Fatal("block at median time past accepted", err)
+	}
+	future := time.Now().Unix() + maxFutureBlockTime + 60
+	if _, err := bc.AddBlock(mineAt(bc, tip, future, address)); !errors.Is(err, ErrFutureBlock){
+		t.Fatal("block from the future accepted", err)
+	}
+	if banScore(fmt.Errorf("%w", ErrFutureBlock)) != 0{
+		t.Fatal("future block charged to the peer")
+	}
+	if _, err := bc.AddBlock(mineAt(bc, tip, mtp+1, address)); err != nil{
+		t.Fatal(err)
+	}
+}
+
+func TestMineBlockAfterMedianTimePast(t *testing.T){
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	tip := tipBlock(t, bc)
+	// blocks up to two hours ahead of our clock are valid
+	ahead := time.Now().Unix() + 3600
+	for i := 0; i < medianTimeBlocks; i++{
+		tip = mineAt(bc, tip, ahead+int64(i), address)
+		if _, err := bc.AddBlock(tip); err != nil{
+			t.Fatal(err)
+		}
+	}
+	block, err := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "", tip.Height+1, 0)})
+	if err != nil{
+		t.Fatal(err)
+	}
+	if mtp := ahead + medianTimeBlocks/2; block.Timestamp != mtp+1{
+		t.Fatalf("mined at %d, median time past is %d", block.Timestamp, mtp)
+	}
+}
+
+func TestDuplicateOutputsRejected(t *testing.T){
+	bc, wallet := newTestChain(t)
+	address := string(wallet.GetAddress())
+	tip := tipBlock(t, bc)
+	// a coinbase with fixed data has the same id at every height
+	coinbase := NewCoinbaseTX(address, "fixed", 1, 0)
+	first := NewBlockAt([]*Transaction{coinbase}, tip.Hash, 1, bc.CalcNextBits(tip.Hash), tip.Timestamp+targetBlockTime)
+	if _, err := bc.AddBlock(first); err != nil{
+		t.Fatal(err)
+	}
+	before := UTXOSet{bc}.Hash().Hash
+	second := NewBlockAt([]*Transaction{coinbase}, first.Hash, 2, bc.CalcNextBits(first.Hash), first.Timestamp+targetBlockTime)
+	if _, err := bc.AddBlock(second); !errors.Is(err, ErrDuplicateOutput){
+		t.Fatal("unspent output overwritten", err)
+	}
+	if !bytes.Equal(UTXOSet{bc}.Hash().Hash, before){
+		t.Fatal("UTXO set changed")
+	}
+	twice := testBlock()
+	twice.Transactions = append(twice.Transactions, twice.Transactions[1])
+	if err := checkTransactions(twice); !errors.Is(err, ErrDuplicateOutput){
+		t.Fatal("transaction repeated in a block", err)
+	}
+}
@@ -8,11 +8,16 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
 )
 
 const version = byte(0x00)
+// addresses with this version pay to the hash of a script, see Multisig
+const scriptHashVersion = byte(0x05)
 const addressChecksumLen = 4
 
+var ErrBadAddress = errors.New("invalid address")
+
 type Wallet struct{
 	PrivateKey ecdsa.PrivateKey
 	PublicKey []byte
@@ -26,11 +31,50 @@ func NewWallet() *Wallet{
 
 func (w Wallet) GetAddress() []byte{
 	pubkeyhash := HashPubKey(w.PublicKey)
-	versionedPayload := append([]byte{version}, pubkeyhash...)
+	return encodeAddress(version, pubkeyhash)
+}
+
+func encodeAddress(version byte, hash []byte) []byte{
+	versionedPayload := append([]byte{version}, hash...)
 	checksum := checkSum(versionedPayload)
 	fullPayload := append(versionedPayload, checksum...)
-	address := Base58Encode(fullPayload)
-	return address
+	return Base58Encode(fullPayload)
+}
+
+// decodeAddress returns the version and hash carried by address
+func decodeAddress(address string) (byte, []byte, error){
+	if len(address) == 0{
+		return 0, nil, ErrBadAddress
+	}
+	for _,c := range []byte(address){
+		if bytes.IndexByte(b58Alphabet, c) < 0{
+			return 0, nil, ErrBadAddress
+		}
+	}
+	payload := Base58Decode([]byte(address))
+	if len(payload) != 1+20+addressChecksumLen{
+		return 0, nil, ErrBadAddress
+	}
+	length := len(payload) - addressChecksumLen
+	if !bytes.Equal(payload[length:], checkSum(payload[:length])){
+		return 0, nil, ErrBadAddress
+	}
+	if payload[0] != version && payload[0] != scriptHashVersion{
+		return 0, nil, ErrBadAddress
+	}
+	return payload[0], payload[1:length], nil
+}
+
+// AddressLockScript returns the lock script paying to address
+func AddressLockScript(address string) ([]byte, error){
+	v, hash, err := decodeAddress(address)
+	if err != nil{
+		return nil, err
+	}
+	if v == scriptHashVersion{
+		return NewP2SHScript(hash), nil
+	}
+	return NewP2PKHScript(hash), nil
 }
 
 func HashPubKey(pubkey []byte) []byte{
@@ -45,13 +89,8 @@ func HashPubKey(pubkey []byte) []byte{
 }
 
 func ValidateAddress(address string) bool{
-	pubkeyhash := Base58Decode([]byte(address))
-	length := len(pubkeyhash) - addressChecksumLen
-	addrcs := pubkeyhash[length:]
-	version := pubkeyhash[0]
-	pubkeyhash = pubkeyhash[1:length]
-	targetcs := checkSum(append([]byte{version}, pubkeyhash...))
-	return bytes.Compare(addrcs, targetcs) == 0
+	_, _, err := decodeAddress(address)
+	return err == nil
 }
 
 func checkSum(payload []byte) []byte{
@@ -66,7 +105,7 @@ func newKeyPair() (ecdsa.PrivateKey, []byte){
 	if err != nil{
 		log.Panic(err)
 	}
-	public := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	public := encodePubKey(&private.PublicKey)
 	return *private, public
 }
 
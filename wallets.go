@@ -10,13 +10,17 @@ import (
 	"bytes"
 )
 
+const walletFile = "wallet_%s.dat"
+
 type Wallets struct{
 	Wallets map[string]*Wallet
+	Multisigs map[string]*Multisig
 }
 
 func NewWallets(nodeID string) (*Wallets, error){
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Multisigs = make(map[string]*Multisig)
 	err := wallets.LoadFromFile(nodeID)
 	return &wallets, err
 }
@@ -40,36 +44,98 @@ func (ws *Wallets) GetWallet(address string) Wallet{
 	return *ws.Wallets[address]
 }
 
+// CreateMultisig adds an m-of-n address over pubkeys, which need not
+// belong to this wallet
+func (ws *Wallets) CreateMultisig(m int, pubkeys [][]byte) (string, error){
+	ms, err := NewMultisig(m, pubkeys)
+	if err != nil{
+		return "", err
+	}
+	address := fmt.Sprintf("%s", ms.GetAddress())
+	ws.Multisigs[address] = ms
+	return address, nil
+}
+
+func (ws *Wallets) GetMultisig(address string) (*Multisig, bool){
+	ms, ok := ws.Multisigs[address]
+	return ms, ok
+}
+
+func (ws *Wallets) GetMultisigAddresses() []string{
+	var addrs []string
+	for addr := range ws.Multisigs{
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// CosignMultisig signs tx with every key of ms held in this wallet and
+// reports how many signed
+func (ws *Wallets) CosignMultisig(ms *Multisig, tx *Transaction) (int, error){
+	signed := 0
+	for _,pubkey := range ms.PubKeys{
+		wallet, ok := ws.Wallets[fmt.Sprintf("%s", encodeAddress(version, HashPubKey(pubkey)))]
+		if !ok{
+			continue
+		}
+		err := ms.Sign(tx, wallet.PrivateKey)
+		if err != nil{
+			return signed, err
+		}
+		signed++
+	}
+	return signed, nil
+}
+
 func (ws *Wallets) LoadFromFile(nodeID string) error{
-	walletFile := fmt.Sprintf(walletFile, nodeID)
-	if _,err := os.Stat(walletFile); os.IsNotExist(err){
+	path := fmt.Sprintf(walletFile, nodeID)
+	if _,err := os.Stat(path); os.IsNotExist(err){
 		return err
 	}
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(path)
 	if err != nil{
 		log.Panic(err)
 	}
 	var wallets Wallets
 	gob.Register(elliptic.P256())
 	dec := gob.NewDecoder(bytes.NewReader(fileContent))
-	err := dec.Decode(&wallets)
+	err = dec.Decode(&wallets)
 	if err != nil{
 		log.Panic(err)
 	}
-	ws.Wallets = wallets.Wallets
+	ws.Wallets = compressKeys(wallets.Wallets)
+	if wallets.Multisigs != nil{
+		ws.Multisigs = wallets.Multisigs
+	}
 	return nil
 }
 
+// compressKeys returns wallets keyed by address after replacing public keys
+// saved before keys were compressed. Those hold X||Y, and SignInput pushes
+// a key that can never hash to their address.
+func compressKeys(wallets map[string]*Wallet) map[string]*Wallet{
+	converted := make(map[string]*Wallet)
+	for address, wallet := range wallets{
+		if len(wallet.PublicKey) != compressedPubKeyLen{
+			wallet.PublicKey = encodePubKey(&wallet.PrivateKey.PublicKey)
+			fmt.Printf("wallet %s now has address %s, coins sent to the old address cannot be spent\n", address, wallet.GetAddress())
+			address = fmt.Sprintf("%s", wallet.GetAddress())
+		}
+		converted[address] = wallet
+	}
+	return converted
+}
+
 func (ws *Wallets) SaveToFile(nodeID string){
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeID)
+	path := fmt.Sprintf(walletFile, nodeID)
 	gob.Register(elliptic.P256())
 	enc := gob.NewEncoder(&content)
 	err := enc.Encode(ws)
 	if err != nil{
 		log.Panic(err)
 	}
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = ioutil.WriteFile(path, content.Bytes(), 0644)
 	if err != nil{
 		log.Panic(err)
 	}
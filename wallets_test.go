@@ -0,0 +1,26 @@
+package blockchain_practice
+
+import (
+	"crypto/elliptic"
+	"testing"
+)
+
+func TestCompressKeys(t *testing.T){
+	legacy, current := NewWallet(), NewWallet()
+	pub := legacy.PrivateKey.PublicKey
+	legacy.PublicKey = elliptic.Marshal(pub.Curve, pub.X, pub.Y)[1:]
+	old := string(legacy.GetAddress())
+	wallets := compressKeys(map[string]*Wallet{old: legacy, string(current.GetAddress()): current})
+	if _, ok := wallets[old]; ok || len(wallets) != 2{
+		t.Fatal("wallet kept its uncompressed address")
+	}
+	for address, w := range wallets{
+		if len(w.PublicKey) != compressedPubKeyLen || address != string(w.GetAddress()){
+			t.Fatalf("%s: key %x", address, w.PublicKey)
+		}
+	}
+	// the converted key is the one SignInput pushes
+	if string(legacy.PublicKey) != string(encodePubKey(&pub)){
+		t.Fatal("key differs from the signing key")
+	}
+}